@@ -0,0 +1,406 @@
+package dgutils
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+/*
+ * Argument types defined by this package, for things that can't be
+ * expressed by plain Go or discordgo types
+ */
+
+//
+// ID of a role. Arguments may be role mentions, IDs or role names. Names are matched
+// case-insensitively, and may be only part of the role's name as long as a single
+// role matches; otherwise, conversion fails with an AmbiguousRole error
+//
+type RoleID string
+
+//
+// ID of any Discord entity. Arguments must be plausible snowflakes: numbers from
+// which a creation time between Discord's epoch and now can be derived
+//
+type Snowflake string
+
+//
+// Returns the time the entity identified by the snowflake was created at
+//
+func (id Snowflake) CreatedAt() time.Time {
+	t, _ := discordgo.SnowflakeTimestamp(string(id))
+	return t
+}
+
+//
+// RGB color, as used by embeds. Arguments may be hex codes, with or without a
+// leading # or 0x, in full (#5865f2) or shorthand (#58f) form, or CSS color names.
+// Registers can accept more names with CmdRegistry.Colors.
+//
+type Color int
+
+//
+// Formats the color as a hex code, i.e. #5865f2
+//
+func (c Color) String() string {
+	return fmt.Sprintf("#%06x", int(c))
+}
+
+//
+// Marker to be embedded in structs that should be accepted as command parameters.
+// Such a struct may only be the last parameter of a command, and takes the rest of
+// the arguments as a JSON object, optionally in a code block, i.e.
+//
+//	!config {"prefix": "?", "greeting": "hi"}
+//
+// Keys that don't match any of the struct's fields are rejected.
+//
+type JSONArg struct{}
+
+//
+// Implemented by parameter types parsed with fmt.Sscanf, for compact structured
+// arguments. ArgFormat returns the format; structs have their exported fields
+// filled in order, other types are scanned into directly, i.e.
+//
+//	type Point struct{ X, Y int }
+//
+//	func (Point) ArgFormat() string { return "%d,%d" }
+//
+// lets a command take "3,4" as a Point. Trailing input is rejected.
+//
+type ScannedArg interface {
+	ArgFormat() string
+}
+
+//
+// Implemented by types that parse arguments themselves. Parameters that are pointers
+// to such types, or to types implementing encoding.TextUnmarshaler, are accepted by
+// Command; ParseArg (or UnmarshalText) is called on a newly allocated value.
+//
+type ArgParser interface {
+	ParseArg(s *discordgo.Session, m *discordgo.MessageCreate, str string) error
+}
+
+//
+// Layouts time.Time arguments are parsed with, in order, see time.Parse. Times
+// without a time zone are taken as UTC. Meant to be changed, if at all, before
+// commands are invoked
+//
+var TimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+var (
+	argParserType       = reflect.TypeOf((*ArgParser)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	scannedArgType      = reflect.TypeOf((*ScannedArg)(nil)).Elem()
+
+	roleIDType    = reflect.TypeOf(RoleID(""))
+	snowflakeType = reflect.TypeOf(Snowflake(""))
+	colorType     = reflect.TypeOf(Color(0))
+	locationType  = reflect.TypeOf(&time.Location{})
+	durationType  = reflect.TypeOf(time.Duration(0))
+	timeType      = reflect.TypeOf(time.Time{})
+	roleType      = reflect.TypeOf(&discordgo.Role{})
+	memberType    = reflect.TypeOf(&discordgo.Member{})
+	jsonArgType   = reflect.TypeOf(JSONArg{})
+
+	builtinConverters = map[reflect.Type]CmdConverter{
+		roleIDType:    parseRoleID,
+		snowflakeType: parseSnowflake,
+		colorType:     parseColor,
+		locationType:  parseLocation,
+		durationType:  parseDuration,
+		timeType:      parseTime,
+		roleType:      parseRole,
+		memberType:    parseMember,
+	}
+	customConverters sync.Map /* reflect.Type to CmdConverter, see RegisterConverter */
+)
+
+//
+// Registers conv as the way arguments of type ttype are converted by every command,
+// taking precedence over the built-in conversion; it's meant for types of your own,
+// such as enums, which Command would otherwise reject. Commands are checked against
+// registered types when created, so converters should be registered before creating
+// commands. A register's Converters still take precedence over conv.
+//
+func RegisterConverter(ttype reflect.Type, conv CmdConverter) {
+	customConverters.Store(ttype, conv)
+}
+
+//
+// Returns the converter registered for ttype, either with RegisterConverter or by
+// this package, or nil if there's none
+//
+func converterFor(ttype reflect.Type) CmdConverter {
+	if conv, ok := customConverters.Load(ttype); ok {
+		return conv.(CmdConverter)
+	}
+	return builtinConverters[ttype]
+}
+
+func parseRoleID(s *discordgo.Session, m *discordgo.MessageCreate, str string) (interface{}, error) {
+	if m == nil || m.GuildID == "" {
+		return nil, errors.New("roles can only be resolved in a guild")
+	}
+	roles, err := guildRoles(s, m.GuildID)
+	if err != nil {
+		return nil, err
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(str, "<@&"), ">")
+	for _, role := range roles {
+		if role.ID == id {
+			return RoleID(role.ID), nil
+		}
+	}
+
+	var exact, partial []*discordgo.Role
+	name := strings.ToLower(str)
+	for _, role := range roles {
+		switch lower := strings.ToLower(role.Name); {
+		case lower == name:
+			exact = append(exact, role)
+		case strings.Contains(lower, name):
+			partial = append(partial, role)
+		}
+	}
+	candidates := exact
+	if len(candidates) == 0 {
+		candidates = partial
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, errors.New("no such role")
+	case 1:
+		return RoleID(candidates[0].ID), nil
+	}
+	ambiguous := AmbiguousRole{Query: str}
+	for _, role := range candidates {
+		ambiguous.Candidates = append(ambiguous.Candidates, role.Name)
+	}
+	sort.Strings(ambiguous.Candidates)
+	return nil, ambiguous
+}
+
+func parseColor(s *discordgo.Session, m *discordgo.MessageCreate, str string) (interface{}, error) {
+	if color, ok := cssColors[strings.ToLower(str)]; ok {
+		return color, nil
+	}
+	hex := strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(str), "#"), "0x")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return nil, fmt.Errorf("'%s' is not a color", str)
+	}
+	color, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not a color", str)
+	}
+	return Color(color), nil
+}
+
+/* Discord's epoch, the earliest time a snowflake can refer to */
+var discordEpoch = time.Unix(1420070400, 0)
+
+func parseSnowflake(s *discordgo.Session, m *discordgo.MessageCreate, str string) (interface{}, error) {
+	if !isSnowflake(str) {
+		return nil, fmt.Errorf("%q is not an ID", str)
+	}
+	created, err := discordgo.SnowflakeTimestamp(str)
+	/* Allow for some clock skew when comparing against the current time */
+	if err != nil || !created.After(discordEpoch) || created.After(time.Now().Add(time.Minute)) {
+		return nil, fmt.Errorf("%q is not a valid ID", str)
+	}
+	return Snowflake(str), nil
+}
+
+//
+// Resolves roles the same way as RoleID, names included
+//
+func parseRole(s *discordgo.Session, m *discordgo.MessageCreate, str string) (interface{}, error) {
+	id, err := parseRoleID(s, m, str)
+	if err != nil {
+		return nil, err
+	}
+	if role, err := s.State.Role(m.GuildID, string(id.(RoleID))); err == nil {
+		return role, nil
+	}
+	roles, err := guildRoles(s, m.GuildID)
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range roles {
+		if role.ID == string(id.(RoleID)) {
+			return role, nil
+		}
+	}
+	return nil, errors.New("no such role")
+}
+
+//
+// Resolves members of the guild m was sent in from mentions or IDs
+//
+func parseMember(s *discordgo.Session, m *discordgo.MessageCreate, str string) (interface{}, error) {
+	if m == nil || m.GuildID == "" {
+		return nil, errors.New("members can only be resolved in a guild")
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(str, "<@"), "!"), ">")
+	if !isSnowflake(id) {
+		return nil, fmt.Errorf("'%s' is not a member", str)
+	}
+	if member, err := s.State.Member(m.GuildID, id); err == nil {
+		return member, nil
+	}
+	member, err := s.GuildMember(m.GuildID, id)
+	if err != nil {
+		return nil, err
+	}
+	member.GuildID = m.GuildID
+	return member, nil
+}
+
+//
+// Returns roles for guild with ID guildID, from state if possible
+//
+func guildRoles(s *discordgo.Session, guildID string) ([]*discordgo.Role, error) {
+	if guild, err := s.State.Guild(guildID); err == nil {
+		return guild.Roles, nil
+	}
+	return s.GuildRoles(guildID)
+}
+
+//
+// Parses durations as understood by time.ParseDuration, such as 10m or 1h30m
+//
+func parseDuration(s *discordgo.Session, m *discordgo.MessageCreate, str string) (interface{}, error) {
+	return time.ParseDuration(str)
+}
+
+//
+// Parses times in any of TimeLayouts
+//
+func parseTime(s *discordgo.Session, m *discordgo.MessageCreate, str string) (interface{}, error) {
+	for _, layout := range TimeLayouts {
+		if t, err := time.Parse(layout, str); err == nil {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("'%s' is not a time, try something like %s", str, time.Now().UTC().Format("2006-01-02 15:04"))
+}
+
+//
+// Parses IANA time zone names, such as America/Sao_Paulo, into a *time.Location
+//
+func parseLocation(s *discordgo.Session, m *discordgo.MessageCreate, str string) (interface{}, error) {
+	/* LoadLocation takes those to mean UTC and the machine's zone, which isn't what users mean */
+	if str == "" || str == "Local" {
+		return nil, errors.New("unknown time zone " + str)
+	}
+	return time.LoadLocation(str)
+}
+
+//
+// Whether ttype is a struct embedding JSONArg
+//
+func isJSONArg(ttype reflect.Type) bool {
+	if ttype.Kind() != reflect.Struct {
+		return false
+	}
+	for c := 0; c < ttype.NumField(); c++ {
+		if field := ttype.Field(c); field.Anonymous && field.Type == jsonArgType {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Unmarshals str, possibly quoted or in a code block, into a new value of type ttype
+//
+func parseJSONArg(ttype reflect.Type, str string) (reflect.Value, error) {
+	str = strings.TrimSpace(str)
+	switch {
+	case strings.HasPrefix(str, "```") && strings.HasSuffix(str, "```") && len(str) >= 6:
+		str = strings.TrimPrefix(str[3:len(str)-3], "json")
+	case len(str) >= 2 && strings.ContainsAny(str[:1], "`'\"") && str[0] == str[len(str)-1]:
+		str = str[1 : len(str)-1]
+	}
+	val := reflect.New(ttype)
+	dec := json.NewDecoder(strings.NewReader(str))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(val.Interface()); err != nil {
+		return reflect.Value{}, UnmarshalError{Why: err}
+	}
+	if dec.More() {
+		return reflect.Value{}, UnmarshalError{Why: errors.New("trailing data after JSON object")}
+	}
+	return val.Elem(), nil
+}
+
+//
+// Whether ttype is a pointer parsed by parsePointerArg
+//
+func isParsedPointer(ttype reflect.Type) bool {
+	return ttype.Kind() == reflect.Ptr &&
+		(ttype.Implements(argParserType) || ttype.Implements(textUnmarshalerType))
+}
+
+func parsePointerArg(s *discordgo.Session, m *discordgo.MessageCreate, ttype reflect.Type, str string) (reflect.Value, error) {
+	val := reflect.New(ttype.Elem())
+	var err error
+	switch parser := val.Interface().(type) {
+	case ArgParser:
+		err = parser.ParseArg(s, m, str)
+	case encoding.TextUnmarshaler:
+		err = parser.UnmarshalText([]byte(str))
+	}
+	if err != nil {
+		return reflect.Value{}, UnmarshalError{Why: err}
+	}
+	return val, nil
+}
+
+//
+// Whether ttype is parsed by parseScannedArg
+//
+func isScannedArg(ttype reflect.Type) bool {
+	return ttype.Kind() != reflect.Ptr && ttype.Implements(scannedArgType)
+}
+
+func parseScannedArg(ttype reflect.Type, str string) (reflect.Value, error) {
+	val := reflect.New(ttype)
+	format := val.Elem().Interface().(ScannedArg).ArgFormat()
+	var targets []interface{}
+	if ttype.Kind() == reflect.Struct {
+		for c := 0; c < ttype.NumField(); c++ {
+			if ttype.Field(c).PkgPath == "" {
+				targets = append(targets, val.Elem().Field(c).Addr().Interface())
+			}
+		}
+	} else {
+		targets = append(targets, val.Interface())
+	}
+	var trailing string
+	n, err := fmt.Sscanf(str, format+"%s", append(targets, &trailing)...)
+	switch {
+	case n == len(targets)+1:
+		return reflect.Value{}, UnmarshalError{Why: fmt.Errorf("unexpected %q after %s", trailing, format)}
+	case n < len(targets):
+		return reflect.Value{}, UnmarshalError{Why: fmt.Errorf("expected %s: %v", format, err)}
+	}
+	return val.Elem(), nil
+}
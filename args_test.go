@@ -0,0 +1,390 @@
+package dgutils
+
+import (
+	"errors"
+	"math/big"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestRoleID(t *testing.T) {
+	s := testSession()
+	s.State.GuildAdd(&discordgo.Guild{
+		ID: "guild",
+		Roles: []*discordgo.Role{
+			{ID: "1", Name: "Moderator"},
+			{ID: "2", Name: "Mod Helper"},
+			{ID: "3", Name: "Admin"},
+			{ID: "4", Name: "admin"},
+		},
+	})
+	m := testMessage("")
+	m.GuildID = "guild"
+
+	valid := map[string]RoleID{
+		"<@&2>":     "2",
+		"3":         "3",
+		"moderator": "1",
+		"helper":    "2",
+	}
+	for str, id := range valid {
+		val, err := tryConvert(s, m, roleIDType, str)
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %s", str, err)
+		} else if val.Interface() != id {
+			t.Errorf("'%s': expected role %s but got %v", str, id, val)
+		}
+	}
+
+	_, err := tryConvert(s, m, roleIDType, "mod")
+	if uerr, ok := err.(UnmarshalError); !ok {
+		t.Errorf("expected UnmarshalError but got %v", err)
+	} else if !reflect.DeepEqual(uerr.Why, AmbiguousRole{"mod", []string{"Mod Helper", "Moderator"}}) {
+		t.Errorf("expected ambiguous role error but got %v", uerr.Why)
+	}
+	if _, err := tryConvert(s, m, roleIDType, "ADMIN"); err == nil {
+		t.Errorf("roles with the same name were not reported as ambiguous")
+	}
+	if _, err := tryConvert(s, m, roleIDType, "nobody"); err == nil {
+		t.Errorf("expected error for unknown role")
+	}
+}
+
+func TestLocation(t *testing.T) {
+	for _, name := range []string{"America/Sao_Paulo", "UTC", "Europe/Lisbon"} {
+		val, err := tryConvert(nil, nil, locationType, name)
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %s", name, err)
+		} else if loc := val.Interface().(*time.Location); loc.String() != name {
+			t.Errorf("expected location %s but got %s", name, loc)
+		}
+	}
+	for _, name := range []string{"", "Local", "Mars/Olympus_Mons", "../../etc/passwd"} {
+		if _, err := tryConvert(nil, nil, locationType, name); err == nil {
+			t.Errorf("'%s': expected an error", name)
+		}
+	}
+}
+
+type testConfig struct {
+	JSONArg
+	Prefix  string `json:"prefix"`
+	Verbose bool   `json:"verbose"`
+}
+
+func TestJSONArg(t *testing.T) {
+	s := testSession()
+	var got testConfig
+	var gotName string
+	reg := Registry()
+	reg.Add("config", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, name string, cfg testConfig) {
+		gotName, got = name, cfg
+	}, "", nil))
+
+	expect := testConfig{Prefix: "? ", Verbose: true}
+	for _, content := range []string{
+		`!config bot {"prefix": "? ", "verbose": true}`,
+		"!config bot `{\"prefix\":\"? \",\"verbose\":true}`",
+		"!config bot ```json\n{\"prefix\": \"? \", \"verbose\": true}\n```",
+	} {
+		got, gotName = testConfig{}, ""
+		if _, _, err := reg.Dispatch(s, testMessage(content), "!"); err != nil {
+			t.Errorf("%q: unexpected error: %s", content, err)
+		} else if got != expect || gotName != "bot" {
+			t.Errorf("%q: expected %+v but got %+v", content, expect, got)
+		}
+	}
+	for _, content := range []string{
+		`!config bot {"prefix": 3}`,
+		`!config bot {"prefx": "?"}`,
+		`!config bot {"prefix": "?"} {}`,
+	} {
+		if _, _, err := reg.Dispatch(s, testMessage(content), "!"); !errors.As(err, &UnmarshalError{}) {
+			t.Errorf("%q: expected UnmarshalError but got %v", content, err)
+		}
+	}
+
+	if _, err := Command(func(s *discordgo.Session, m *discordgo.MessageCreate, cfg testConfig, n int) {
+	}, "", nil); err == nil {
+		t.Errorf("JSON struct was accepted before another parameter")
+	}
+	if _, err := Command(func(s *discordgo.Session, m *discordgo.MessageCreate, p struct{ X, Y int }) {
+	}, "", nil); err == nil {
+		t.Errorf("struct not embedding JSONArg was accepted")
+	}
+}
+
+type testPoint struct{ X, Y int }
+
+func (testPoint) ArgFormat() string { return "%d,%d" }
+
+type testHex uint
+
+func (testHex) ArgFormat() string { return "0x%x" }
+
+func TestScannedArg(t *testing.T) {
+	s := testSession()
+	var gotPoint testPoint
+	var gotHex testHex
+	reg := Registry()
+	reg.Add("move", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, p testPoint, h testHex) {
+		gotPoint, gotHex = p, h
+	}, "", nil))
+
+	if _, _, err := reg.Dispatch(s, testMessage("!move 3,-4 0xff"), "!"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if gotPoint != (testPoint{3, -4}) || gotHex != 0xff {
+		t.Errorf("expected ({3 -4}, 0xff) but got (%v, %#x)", gotPoint, gotHex)
+	}
+	for _, content := range []string{"!move 3 0xff", "!move 3,4,5 0xff", "!move 3,x 0xff", "!move 3,4 ff"} {
+		if _, _, err := reg.Dispatch(s, testMessage(content), "!"); !errors.As(err, &UnmarshalError{}) {
+			t.Errorf("%q: expected UnmarshalError but got %v", content, err)
+		}
+	}
+}
+
+type testMood string
+
+func (mood *testMood) ParseArg(s *discordgo.Session, m *discordgo.MessageCreate, str string) error {
+	if str != "happy" && str != "sad" {
+		return errors.New("unknown mood " + str)
+	}
+	*mood = testMood(m.Author.ID + " is " + str)
+	return nil
+}
+
+func TestParsedPointers(t *testing.T) {
+	s := testSession()
+	var gotMood *testMood
+	var gotN *big.Int
+	reg := Registry()
+	reg.Add("feel", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, mood *testMood, n *big.Int) {
+		gotMood, gotN = mood, n
+	}, "", nil))
+
+	if _, _, err := reg.Dispatch(s, testMessage("!feel happy 123456789012345678901234567890"), "!"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if *gotMood != "user is happy" || gotN.String() != "123456789012345678901234567890" {
+		t.Errorf("expected (user is happy, 123456789012345678901234567890) but got (%s, %s)", *gotMood, gotN)
+	}
+	for _, content := range []string{"!feel meh 1", "!feel sad one"} {
+		if _, _, err := reg.Dispatch(s, testMessage(content), "!"); !errors.As(err, &UnmarshalError{}) {
+			t.Errorf("%q: expected UnmarshalError but got %v", content, err)
+		}
+	}
+}
+
+func TestSnowflake(t *testing.T) {
+	id, err := tryConvert(nil, nil, snowflakeType, "175928847299117063")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if created := id.Interface().(Snowflake).CreatedAt().UTC(); created.Format(time.RFC3339) != "2016-04-30T11:18:25Z" {
+		t.Errorf("unexpected creation time %s", created)
+	}
+	for _, str := range []string{"", "0", "123", "abc", "<@175928847299117063>", "99999999999999999999", "9175928847299117063"} {
+		if _, err := tryConvert(nil, nil, snowflakeType, str); !errors.As(err, &UnmarshalError{}) {
+			t.Errorf("expected UnmarshalError for %q but got %v", str, err)
+		}
+	}
+}
+
+func TestColor(t *testing.T) {
+	reg := Registry()
+	reg.Colors = map[string]Color{"brandBlue": 0x5865f2, "bad": 0x123456}
+	for str, expect := range map[string]Color{
+		"#5865f2":       0x5865f2,
+		"5865F2":        0x5865f2,
+		"0x5865f2":      0x5865f2,
+		"#58f":          0x5588ff,
+		"RebeccaPurple": 0x663399,
+		"brandblue":     0x5865f2,
+		"BAD":           0x123456, /* would otherwise be #bbaadd */
+		"#bad":          0xbbaadd,
+	} {
+		color, err := reg.convert(nil, nil, colorType, str)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", str, err)
+		} else if color.Interface() != expect {
+			t.Errorf("expected %s for %q but got %s", expect, str, color.Interface())
+		}
+	}
+	for _, str := range []string{"", "#12345", "#gggggg", "brandred", "#5865f2ff"} {
+		if _, err := reg.convert(nil, nil, colorType, str); !errors.As(err, &UnmarshalError{}) {
+			t.Errorf("expected UnmarshalError for %q but got %v", str, err)
+		}
+	}
+	if str := Color(0x00ff7f).String(); str != "#00ff7f" {
+		t.Errorf("expected #00ff7f but got %s", str)
+	}
+}
+
+func TestRoleAndMember(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	s.State.GuildAdd(&discordgo.Guild{
+		ID:    "guild",
+		Roles: []*discordgo.Role{{ID: "1", Name: "Moderator"}, {ID: "2", Name: "Member"}},
+		Members: []*discordgo.Member{
+			{GuildID: "guild", User: &discordgo.User{ID: "10", Username: "alice"}},
+		},
+	})
+	var role *discordgo.Role
+	var member *discordgo.Member
+	reg := Registry()
+	reg.Add("grant", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, r *discordgo.Role, who *discordgo.Member) {
+		role, member = r, who
+	}, "", nil))
+	m := testMessage("")
+	m.GuildID = "guild"
+
+	for _, args := range [][]string{{"<@&1>", "<@!10>"}, {"1", "<@10>"}, {"moderator", "10"}} {
+		role, member = nil, nil
+		if err := reg.Exec(s, m, "grant", args...); err != nil {
+			t.Errorf("%q: unexpected error: %s", args, err)
+		} else if role.ID != "1" || member.User.ID != "10" {
+			t.Errorf("%q: got role %v and member %v", args, role, member)
+		}
+	}
+	if len(reqs) != 0 {
+		t.Errorf("expected roles and members to be found in state, got %d requests", len(reqs))
+	}
+	if err := reg.Exec(s, m, "grant", "<@&3>", "10"); !errors.As(err, &UnmarshalError{}) {
+		t.Errorf("expected UnmarshalError for unknown role but got %v", err)
+	}
+	if err := reg.Exec(s, m, "grant", "1", "alice"); !errors.As(err, &UnmarshalError{}) {
+		t.Errorf("expected UnmarshalError for member name but got %v", err)
+	}
+	if err := reg.Exec(s, testMessage(""), "grant", "1", "10"); !errors.As(err, &UnmarshalError{}) {
+		t.Errorf("expected UnmarshalError outside of a guild but got %v", err)
+	}
+
+	if err := reg.Exec(s, m, "grant", "1", "20"); err != nil {
+		t.Errorf("unexpected error fetching member: %s", err)
+	} else if len(reqs) != 1 || !strings.HasSuffix(reqs[0].URL.Path, "/guilds/guild/members/20") {
+		t.Errorf("expected member to be fetched, got %v", reqs)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	s := testSession()
+	var got time.Duration
+	reg := Registry()
+	reg.Add("mute", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, d time.Duration) {
+		got = d
+	}, "", nil))
+
+	for str, expect := range map[string]time.Duration{
+		"10m":   10 * time.Minute,
+		"1h30m": 90 * time.Minute,
+		"500ms": 500 * time.Millisecond,
+	} {
+		if err := reg.Exec(s, testMessage(""), "mute", str); err != nil {
+			t.Errorf("%q: unexpected error: %s", str, err)
+		} else if got != expect {
+			t.Errorf("%q: expected %s but got %s", str, expect, got)
+		}
+	}
+	for _, str := range []string{"10", "ten minutes", "1x"} {
+		err := reg.Exec(s, testMessage(""), "mute", str)
+		var uerr UnmarshalError
+		if !errors.As(err, &uerr) || !strings.Contains(uerr.Why.Error(), "time: ") {
+			t.Errorf("%q: expected UnmarshalError from time.ParseDuration but got %v", str, err)
+		}
+	}
+}
+
+func TestTime(t *testing.T) {
+	for str, expect := range map[string]time.Time{
+		"2024-01-02T15:04:05-03:00": time.Date(2024, 1, 2, 15, 4, 5, 0, time.FixedZone("", -3*60*60)),
+		"2024-01-02T15:04":          time.Date(2024, 1, 2, 15, 4, 0, 0, time.UTC),
+		"2024-01-02":                time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+	} {
+		val, err := tryConvert(nil, nil, timeType, str)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", str, err)
+		} else if got := val.Interface().(time.Time); !got.Equal(expect) {
+			t.Errorf("%q: expected %s but got %s", str, expect, got)
+		}
+	}
+	for _, str := range []string{"", "tomorrow", "2024-13-01", "02/01/2024"} {
+		if _, err := tryConvert(nil, nil, timeType, str); !errors.As(err, &UnmarshalError{}) {
+			t.Errorf("%q: expected UnmarshalError but got %v", str, err)
+		}
+	}
+
+	defer func(layouts []string) { TimeLayouts = layouts }(TimeLayouts)
+	TimeLayouts = append(TimeLayouts, "02/01/2006")
+	if _, err := tryConvert(nil, nil, timeType, "02/01/2024"); err != nil {
+		t.Errorf("expected custom layout to be accepted, got %s", err)
+	}
+}
+
+type testFruit string
+
+func TestRegisterConverter(t *testing.T) {
+	RegisterConverter(reflect.TypeOf(testFruit("")), func(s *discordgo.Session, m *discordgo.MessageCreate, str string) (interface{}, error) {
+		switch fruit := testFruit(strings.ToLower(str)); fruit {
+		case "apple", "banana":
+			return fruit, nil
+		}
+		return nil, errors.New("no such fruit")
+	})
+	defer customConverters.Delete(reflect.TypeOf(testFruit("")))
+
+	var got testFruit
+	reg := Registry()
+	reg.Add("eat", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, fruit testFruit) {
+		got = fruit
+	}, "", nil))
+	s := testSession()
+	if err := reg.Exec(s, testMessage(""), "eat", "Banana"); err != nil || got != "banana" {
+		t.Errorf("expected banana but got %q (%v)", got, err)
+	}
+	if err := reg.Exec(s, testMessage(""), "eat", "rock"); err == nil {
+		t.Errorf("expected unknown fruit to be rejected")
+	}
+}
+
+func TestMessageLink(t *testing.T) {
+	s := testSession()
+	s.State.MaxMessageCount = 10
+	s.State.GuildAdd(&discordgo.Guild{ID: "1", Channels: []*discordgo.Channel{{ID: "10", GuildID: "1"}}})
+	s.State.GuildAdd(&discordgo.Guild{ID: "2", Channels: []*discordgo.Channel{{ID: "20", GuildID: "2"}}})
+	s.State.ChannelAdd(&discordgo.Channel{ID: "30", Type: discordgo.ChannelTypeDM})
+	for _, ids := range [][2]string{{"10", "100"}, {"20", "200"}, {"30", "300"}} {
+		s.State.MessageAdd(&discordgo.Message{ChannelID: ids[0], ID: ids[1]})
+	}
+	inGuild, inDM := testMessage(""), testMessage("")
+	inGuild.GuildID, inGuild.ChannelID = "1", "10"
+	inDM.ChannelID = "30"
+
+	link := "https://discord.com/channels/"
+	for _, c := range []struct {
+		m     *discordgo.MessageCreate
+		link  string
+		allow bool
+	}{
+		{inGuild, link + "1/10/100", true},
+		{inGuild, link + "2/20/200", false},
+		{inGuild, link + "1/20/200", false}, /* lying about the guild */
+		{inGuild, link + "@me/30/300", false},
+		{inDM, link + "@me/30/300", true},
+		{inDM, link + "1/10/100", false},
+		{nil, link + "1/10/100", false},
+	} {
+		msg, err := tryConvert(s, c.m, messageType, c.link)
+		if c.allow && (err != nil || msg.Interface().(*discordgo.Message).ChannelID == "") {
+			t.Errorf("%s: unexpected error: %v", c.link, err)
+		} else if !c.allow && !errors.As(err, &UnmarshalError{}) {
+			t.Errorf("%s: expected UnmarshalError but got %v", c.link, err)
+		}
+	}
+}
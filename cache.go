@@ -0,0 +1,116 @@
+package dgutils
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+//
+// Caches replies of commands whose output depends only on their arguments, see
+// FnCmd.Cache. Replies are reused for TTL after the command first produced them,
+// for the same command and arguments. At most Size replies are kept; when full,
+// the oldest is dropped to make room. A cache may be shared by several commands.
+// Replies carrying files aren't cached, as their readers can only be sent once.
+//
+type CmdCache struct {
+	TTL     time.Duration
+	Size    int
+	lock    sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	name    string /* command the reply belongs to, for Invalidate */
+	reply   *discordgo.MessageSend
+	expires time.Time
+}
+
+//
+// Creates a cache keeping up to size replies for ttl each
+//
+func Cache(ttl time.Duration, size int) *CmdCache {
+	return &CmdCache{TTL: ttl, Size: size, entries: map[string]cacheEntry{}}
+}
+
+//
+// Drops every cached reply of the command with canonical name name
+//
+func (c *CmdCache) Invalidate(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, entry := range c.entries {
+		if entry.name == name {
+			delete(c.entries, key)
+		}
+	}
+}
+
+//
+// Drops every cached reply
+//
+func (c *CmdCache) Purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = map[string]cacheEntry{}
+}
+
+//
+// Identifies the reply of cmd, invoked as name, to args. Both the command and its
+// name are part of the key, so commands sharing a cache never get each other's
+// replies, even when invoked outside of a register (where name is empty).
+// args should be the full argument list, flags included
+//
+func cacheKeyFor(cmd interface{}, name string, args []string) string {
+	key := []string{fmt.Sprintf("%p", cmd), name}
+	for _, arg := range args {
+		key = append(key, strings.TrimSpace(arg))
+	}
+	return strings.Join(key, "\x00")
+}
+
+//
+// Returns the reply cached under key, if any
+//
+func (c *CmdCache) get(key string) (*discordgo.MessageSend, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.reply, ok
+}
+
+//
+// Caches reply under key, as a reply of the command with canonical name name
+//
+func (c *CmdCache) put(key, name string, reply *discordgo.MessageSend) {
+	if c.Size <= 0 || (reply != nil && (reply.File != nil || len(reply.Files) > 0)) {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]cacheEntry{}
+	}
+	now := time.Now()
+	if len(c.entries) >= c.Size {
+		var oldest string
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			} else if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+				oldest = key
+			}
+		}
+		if len(c.entries) >= c.Size {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[key] = cacheEntry{name, reply, now.Add(c.TTL)}
+}
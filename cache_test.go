@@ -0,0 +1,111 @@
+package dgutils
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestCache(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	calls := 0
+	lookup := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, n int) string {
+		calls++
+		return strconv.Itoa(n * n)
+	}, "", nil)
+	lookup.Cache = Cache(time.Hour, 2)
+	reg := Registry()
+	reg.Add("square", lookup)
+
+	run := func(content string) {
+		if _, _, err := reg.Dispatch(s, testMessage(content), "!"); err != nil {
+			t.Fatalf("%q: unexpected error: %s", content, err)
+		}
+	}
+
+	run("!square 3")
+	run("!square 3")
+	if calls != 1 || len(reqs) != 2 {
+		t.Errorf("expected one call and two replies, got %d calls and %d replies", calls, len(reqs))
+	}
+	run("!square 4")
+	run("!square 5") /* evicts 3 */
+	run("!square 3")
+	if calls != 4 {
+		t.Errorf("expected the oldest reply to be evicted, got %d calls", calls)
+	}
+	if len(lookup.Cache.entries) != 2 {
+		t.Errorf("expected cache to be bounded to 2 entries, got %d", len(lookup.Cache.entries))
+	}
+
+	lookup.Cache.Invalidate("square")
+	run("!square 3")
+	if calls != 5 {
+		t.Errorf("expected invocation after invalidation, got %d calls", calls)
+	}
+
+	lookup.Cache.TTL = -time.Second
+	lookup.Cache.Purge()
+	run("!square 3")
+	run("!square 3")
+	if calls != 7 {
+		t.Errorf("expected expired replies not to be reused, got %d calls", calls)
+	}
+}
+
+func TestCacheFlags(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	calls := 0
+	build := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, v bool) string {
+		calls++
+		if v {
+			return "verbose"
+		}
+		return "quiet"
+	}, "", nil)
+	if err := build.Shorthand(0, 'v'); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	/* Built without Cache, which must work all the same */
+	build.Cache = &CmdCache{TTL: time.Hour, Size: 10}
+	reg := Registry()
+	reg.Add("b", build)
+
+	for _, content := range []string{"!b -v", "!b", "!b -v", "!b"} {
+		if _, _, err := reg.Dispatch(s, testMessage(content), "!"); err != nil {
+			t.Fatalf("%q: unexpected error: %s", content, err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected flags to be part of the cache key, got %d calls", calls)
+	}
+}
+
+func TestCacheShared(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	cache := Cache(time.Hour, 10)
+	calls := 0
+	cmd := func(reply string) *FnCmd {
+		c := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) string {
+			calls++
+			return reply
+		}, "", nil)
+		c.Cache = cache
+		return c
+	}
+	a, b := cmd("a"), cmd("b")
+	for _, c := range []*FnCmd{a, b, a, b} {
+		if err := c.Invoke(s, testMessage("!x"), nil); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected each command to be cached apart, got %d calls", calls)
+	}
+}
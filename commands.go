@@ -1,12 +1,21 @@
 package dgutils
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/bwmarrin/discordgo"
 )
@@ -16,6 +25,124 @@ type Cmd interface {
 	ErrorHandler() CmdErrorHandler
 }
 
+//
+// Implemented by commands that produce a reply, or that make use of register-level
+// configuration (such as CmdRegistry.Converters). Instead of the command sending
+// the reply itself, it is handed back so that the register can route it (see
+// CmdRegistry.Webhooks).
+//
+type replyingCmd interface {
+	Cmd
+	invokeReply(
+		inv *invocation,
+		s *discordgo.Session,
+		m *discordgo.MessageCreate,
+		args []string,
+	) (*discordgo.MessageSend, error)
+}
+
+//
+// State of a single command invocation
+//
+type invocation struct {
+	reg       *CmdRegistry     /* register the command is invoked through, may be nil */
+	name      string           /* canonical name of the command, if invoked through a register */
+	id        RequestID
+	pending   []func() error   /* run once arguments are converted, see afterParse */
+	converted bool             /* whether parsed ran, i.e. predicates and arguments checked out */
+	capture   bool             /* keep the reply in reply rather than sending it, for pipelines */
+	reply     *discordgo.MessageSend
+	handler   *CmdErrorHandler /* of the subcommand resolved, shared with subinvocations */
+}
+
+//
+// Unique identifier of a command invocation, meant for telling apart log lines
+// of concurrent invocations. Command functions may receive it by declaring a
+// RequestID parameter right after the message
+//
+type RequestID string
+
+/* Types registered with InjectType */
+var injectTypes sync.Map
+
+//
+// Registers the type of sample, i.e. InjectType((*MyDB)(nil)), as a dependency that
+// command functions may receive by declaring a parameter of that type right after
+// the message, instead of through globals. The value is taken from the Deps of the
+// register the command is invoked through. Commands are checked against registered
+// types when created, so types should be registered before creating commands.
+//
+func InjectType(sample interface{}) {
+	injectTypes.Store(reflect.TypeOf(sample), true)
+}
+
+//
+// Whether parameters of type ttype are supplied by us rather than the user
+//
+func isInjected(ttype reflect.Type) bool {
+	if ttype == requestIDType || ttype == contextType {
+		return true
+	}
+	_, ok := injectTypes.Load(ttype)
+	return ok
+}
+
+//
+// Returns the context commands run with, derived from the register's BaseContext
+// and cancelled after Timeout, if set
+//
+func (inv *invocation) context() (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	if inv.reg != nil && inv.reg.BaseContext != nil {
+		ctx = inv.reg.BaseContext
+	}
+	if inv.reg != nil && inv.reg.Timeout > 0 {
+		return context.WithTimeout(ctx, inv.reg.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+//
+// Defers fn until the command's arguments are converted, or until it's invoked for
+// commands that don't convert any, so that cooldowns (see CmdPredicate.record) only
+// count invocations that get that far
+//
+func (inv *invocation) afterParse(fn func() error) {
+	inv.pending = append(inv.pending, fn)
+}
+
+//
+// Runs, in order, what was deferred with afterParse, stopping at the first error
+//
+func (inv *invocation) parsed() error {
+	pending := inv.pending
+	inv.pending = nil
+	for _, fn := range pending {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	inv.converted = true
+	return nil
+}
+
+//
+// Returns the value of an injected parameter of type ttype
+//
+func (inv *invocation) inject(ttype reflect.Type) (reflect.Value, error) {
+	if ttype == requestIDType {
+		return reflect.ValueOf(inv.id), nil
+	}
+	if inv.reg == nil || inv.reg.Deps == nil {
+		return reflect.Value{}, fmt.Errorf("no dependency of type %s to inject", ttype)
+	}
+	deps := reflect.ValueOf(inv.reg.Deps)
+	if !deps.Type().AssignableTo(ttype) {
+		return reflect.Value{}, fmt.Errorf("can't inject %s as %s", deps.Type(), ttype)
+	}
+	return deps, nil
+}
+
 //
 // Command backed by a Go function. Arguments are reflected and automatically
 // converted at runtime.
@@ -23,44 +150,314 @@ type Cmd interface {
 // the command may be executed.
 // ErrHandler is an optional error handling function that may be invoked in
 // case the command fails to be invoked.
+// AggregateErrors makes Invoke convert every element of a trailing slice argument
+// before failing, reporting all invalid elements at once instead of only the first.
+// LongRunning shows the typing indicator for as long as the function runs, for
+// commands that take a while to reply. It has no effect in direct messages.
+// Cache optionally stores the command's replies, so that invoking it again with
+// the same arguments resends the earlier reply instead of running the function.
+// Only suitable for read-only commands whose output depends only on arguments.
+// Exclusive rejects invocations by users who already have one running with
+// AlreadyRunning, for commands that shouldn't overlap, such as a game's turn.
+// BeforeArg, if set, is called before converting each argument that isn't part of a
+// trailing slice or JSON struct, and may pick the type it's converted to based on
+// the arguments converted so far, see CmdArgHook.
 //
 type FnCmd struct {
-	Help       string
-	fn         interface{}
-	Predicate  CmdPredicate
-	ErrHandler CmdErrorHandler
-	paramTypes []reflect.Type
+	Help            string
+	fn              interface{}
+	Predicate       CmdPredicate
+	ErrHandler      CmdErrorHandler
+	AggregateErrors bool
+	LongRunning     bool
+	Cache           *CmdCache
+	Exclusive       bool
+	BeforeArg       CmdArgHook
+	running         *sync.Map      /* IDs of users with an invocation in progress */
+	injected        []reflect.Type /* parameters supplied by us rather than the user */
+	paramTypes      []reflect.Type
+	params          []paramInfo     /* per-parameter options, parallel to paramTypes */
+	bound           []reflect.Value /* arguments fixed by Bind */
 }
 
+//
+// Tokenizer is an optional function used by Handle to split a message's content,
+// with the prefix already stripped, into the command name followed by its
+// arguments. If nil, content is split with Tokenize.
+// MaxContentLength, if non-zero, is the maximum length in bytes of a message Handle
+// will attempt to parse. Longer prefixed messages are rejected with ContentTooLong
+// before being tokenized.
+// Webhooks maps channel IDs to webhooks that command replies in that channel should
+// be sent through, so they can be posted under a custom identity. Replies in other
+// channels are sent normally.
+// Converters maps argument types to functions used to convert them when commands
+// are invoked through this register. They take precedence over the built-in
+// conversion, so they can be used both to support new types (as long as they're
+// accepted by Command) and to parse supported types differently.
+// MaxPipeline is the maximum number of commands HandlePipeline will run for a
+// single message.
+// HelpTokens are arguments that, when given as the first argument to a command,
+// make it reply with its usage and help string instead of running, i.e. "?" or
+// "--help". Commands the user isn't allowed to run fail as usual.
+// SuppressMentions keeps replies of commands invoked through the register from
+// pinging anyone, unless they set AllowedMentions themselves, so that commands
+// echoing user input can't be used to ping @everyone. See also EscapeContent.
+// Deps is injected into commands declaring a parameter of its type, see InjectType.
+// StateWait is how long a command invoked in a guild that isn't in state yet, as
+// happens right after connecting, waits for the guild to be received before
+// running anyway. Without it, such commands may fail or resort to API calls while
+// looking up channels, roles and permissions.
+// FileThreshold, if non-zero, is the length in characters past which replies are
+// sent as a text file instead, for commands dumping large output. Replies with
+// attachments are never sent through Webhooks.
+// WarmGuilds makes the first command invoked in each guild fetch all of its roles
+// and members into state with WarmGuild before running, for registers with
+// commands resolving lots of them. Guilds failing to warm are tried again on the
+// next command.
+// NotFoundMessages maps argument types to messages explaining that an argument of
+// that type couldn't be found, such as "I couldn't find that user, they may have
+// left the server". Conversion errors for those types carry it as a UserFacing
+// error (see ReplyError), unless the lookup failed for transient reasons.
+// Colors maps names to colors accepted for Color arguments, i.e. brand colors,
+// in addition to CSS color names and hex codes. Names are matched case-insensitively
+// and take precedence over both, even when they'd also be valid hex.
+// Default is the command invoked when the register is used as a command grouping
+// subcommands (see Invoke) and no subcommand is given.
+// CaseInsensitive makes command names and aliases match regardless of case, so that
+// !Help runs help; they're stored in lower case, and names differing only in case
+// conflict. It should be set before adding commands.
+// MentionPrefix makes mentioning the bot at the very start of a message work as a
+// prefix, in addition to those given to Handle and the like, as in @Bot help.
+// Observer, if set, is told about every command invoked through the register once
+// it's done, i.e. to keep metrics on them, see CmdObserver.
+// Logf, if set, is called on events of interest to whoever runs the bot, rather than
+// its users: messages matching a prefix, resolving to a command (or not), and
+// commands being denied, failing to parse their arguments or failing outright. level
+// is "debug" for the former, "info" for denials and bad arguments and "error" for
+// anything else. Lines start with the request ID in brackets (see RequestID), so
+// those about the same message can be told apart from concurrent ones.
+// BaseContext is the context contexts given to commands are derived from, so that
+// they can be cancelled on shutdown; it defaults to context.Background().
+// Timeout, if non-zero, is how long commands invoked through the register may run
+// before their context is cancelled. It's up to them to give up once it is.
+// GlobalPredicate is checked for every prefixed message, as well as by Exec, before
+// the command is even looked up, i.e. for a maintenance mode or channels the bot
+// should keep quiet in; messages failing it are reported to the error handler as
+// the predicate's error, usually AccessDenied. Commands' own predicates are still checked afterwards.
+// ReportUnknown makes Handle and the like report prefixed messages naming no known
+// command to the error handler as NoSuchCommand, i.e. to point users to help.
+// Messages without a prefix are still ignored.
+// Cmds and Aliases are guarded by a lock once the register is in use, as commands
+// may be dispatched from several goroutines at once. From then on, they should
+// only be changed through Add, Alias, Remove and Unalias, and read through Get,
+// Canon or Snapshot; accessing them directly is a data race.
+//
 type CmdRegistry struct {
-	Cmds    map[string]Cmd
-	Aliases map[string]string
+	Cmds             map[string]Cmd
+	Aliases          map[string]string
+	Tokenizer        CmdTokenizer
+	MaxContentLength int
+	Webhooks         map[string]CmdWebhook
+	Converters       map[reflect.Type]CmdConverter
+	MaxPipeline      int
+	HelpTokens       []string
+	SuppressMentions bool
+	Deps             interface{}
+	StateWait        time.Duration
+	FileThreshold    int
+	WarmGuilds       bool
+	NotFoundMessages map[reflect.Type]string
+	Colors           map[string]Color
+	Default          Cmd
+	CaseInsensitive  bool
+	MentionPrefix    bool
+	ReportUnknown    bool
+	GlobalPredicate  CmdPredicate
+	Observer         CmdObserver
+	Logf             CmdLogFunc
+	BaseContext      context.Context
+	Timeout          time.Duration
+	auditHook        CmdAuditHook
+	permResolver     CmdPermissionResolver
+	middleware       []CmdMiddleware
+	lock             sync.RWMutex /* guards Cmds, Aliases and middleware */
+	parent           *CmdRegistry /* register this one is an overlay of, see Overlay */
+	stats            sync.Map     /* canonical name -> *uint64 invocation count */
+	warmed           sync.Map     /* guild ID -> struct{}, see WarmGuilds */
+}
+
+//
+// Number of times a command was invoked through a register
+//
+type CmdStat struct {
+	Name  string
+	Count uint64
+}
+
+//
+// Webhook replies can be sent through. Username and AvatarURL optionally override
+// the webhook's default identity
+//
+type CmdWebhook struct {
+	ID, Token           string
+	Username, AvatarURL string
+}
+
+//
+// Options of a single command parameter
+//
+type paramInfo struct {
+	keyword   string /* literal word the bool parameter matches, see FnCmd.Keyword */
+	shorthand rune   /* letter setting the bool parameter, see FnCmd.Shorthand */
+	maxLength int    /* in runes, see FnCmd.MaxLength */
+	optional  bool   /* may be left out, see FnCmd.Optional */
+	rest      bool   /* takes the rest of the line, see FnCmd.RestOfLine */
 }
 
 //
 // Describes in which condition a command may be executed.
 // Permissions is a bitfield describing necessary user premissions for
-// invoking the command.
+// invoking the command. Commands requiring permissions can only be used in guilds,
+// in direct messages they fail with WrongContext without looking anything up.
 // AdministratorOverrides defines whether a member having Adminstrator
-// permission should bypass the predicate
+// permission should bypass the predicate. MemberHasPermissions already grants
+// administrators every permission, so it only matters with a PermissionResolver.
+// BotOwnerOnly restricts the command to the bot's owners, see IsBotOwner.
 // Custom is a function that can be used to check for logic not directly
-// implemented by a predicate.
+// implemented by a predicate. It returns whether the user may run the command,
+// like every other check; it used to be the other way around, returning true to
+// deny, so older custom checks need to be negated.
+// ThreadOnly, NoThreads and ForumOnly restrict the command to threads, to channels
+// that aren't threads, or to forum posts (threads in forum channels), respectively.
+// Category restricts the command to channels (and their threads) under the category
+// with that ID, see InCategory.
+// Scope restricts the command to guilds or to direct messages, see CmdScope.
+// Cooldown optionally limits how often users may run the command. It's checked last,
+// and invocations only count towards it once the command's arguments are converted,
+// so those denied for other reasons or failing on bad arguments don't.
 //
 type CmdPredicate struct {
-	Permissions int
+	Permissions            int
 	AdministratorOverrides bool
-	Custom      CmdPredicateFunc
+	BotOwnerOnly           bool
+	Custom                 CmdPredicateFunc
+	ThreadOnly             bool
+	NoThreads              bool
+	ForumOnly              bool
+	Category               string
+	Scope                  CmdScope
+	Cooldown               *CmdCooldown
+}
+
+//
+// Receives the outcome of every command invoked through a register, see
+// CmdRegistry.Observer. OnInvoke is called once the command is done, with its
+// request ID (see RequestID), canonical name, how long it took (middleware included)
+// and the error it failed with, if any. It may be called from several goroutines at
+// once
+//
+type CmdObserver interface {
+	OnInvoke(id RequestID, name string, dur time.Duration, err error)
 }
 
+//
+// Where a command may be used, regardless of channel. Commands used outside of their
+// scope fail with WrongContext before anything is looked up
+//
+type CmdScope int
+
+const (
+	AnyScope  CmdScope = iota /* both guilds and direct messages */
+	GuildOnly                 /* only in guilds, for commands relying on GuildID */
+	DMOnly                    /* only in direct messages */
+)
+
+//
+// Handles errors of commands invoked through a register. Errors are handed to it as
+// RequestError, so that they can be logged along with their request ID; use
+// errors.As and errors.Is to tell them apart
+//
 type CmdErrorHandler func(*discordgo.Session, *discordgo.MessageCreate, error)
 type CmdPredicateFunc func(*discordgo.Session, *discordgo.MessageCreate, CmdPredicate) bool
+type CmdTokenizer func(content string) ([]string, error)
+type CmdPrefixFunc func(s *discordgo.Session, m *discordgo.MessageCreate) string
+
+type CmdAuditHook func(s *discordgo.Session, m *discordgo.MessageCreate, id RequestID, name string, args []interface{})
+type CmdConverter func(s *discordgo.Session, m *discordgo.MessageCreate, str string) (interface{}, error)
+type CmdMiddleware func(next Cmd) Cmd
+type CmdLogFunc func(level, format string, args ...interface{})
+type CmdPermissionResolver func(s *discordgo.Session, m *discordgo.MessageCreate, required int) (bool, error)
+
+//
+// Escape hatch for commands whose arguments mean different things depending on
+// earlier ones, such as !give <type> <amount|item>. It's called with the index of
+// the parameter about to be converted (not counting parameters fixed by Bind), the
+// values of the parameters converted so far and the raw argument, and returns the
+// type to convert the argument to, or nil for the parameter's own type. The type
+// must be assignable to the parameter, so the parameter is usually an interface{},
+// which the command then type switches on, i.e.
+//
+//	give.BeforeArg = func(index int, parsed []reflect.Value, raw string) (reflect.Type, error) {
+//		if index == 1 && parsed[0].String() == "coins" {
+//			return reflect.TypeOf(0), nil
+//		}
+//		return nil, nil
+//	}
+//
+// Errors returned by the hook fail the invocation as UnmarshalError, wrapped in an
+// ArgParseError.
+//
+type CmdArgHook func(index int, parsed []reflect.Value, raw string) (reflect.Type, error)
+
+const (
+	variationSelectors = "\uFE0E\uFE0F"
+	statePollInterval  = 50 * time.Millisecond /* see CmdRegistry.StateWait */
+	replyFileName      = "output.txt"          /* see CmdRegistry.FileThreshold */
+)
 
 var (
 	sessionType      = reflect.TypeOf(&discordgo.Session{})
 	messageEventType = reflect.TypeOf(&discordgo.MessageCreate{})
 	channelType      = reflect.TypeOf(&discordgo.Channel{})
 	userType         = reflect.TypeOf(&discordgo.User{})
-	illegalKinds     = map[reflect.Kind]bool{
+	messageType      = reflect.TypeOf(&discordgo.Message{})
+	stringType       = reflect.TypeOf("")
+	anyType          = reflect.TypeOf((*interface{})(nil)).Elem()
+	messageSendType  = reflect.TypeOf(&discordgo.MessageSend{})
+	resultsType      = reflect.TypeOf([]TargetResult{})
+	errorType        = reflect.TypeOf((*error)(nil)).Elem()
+	requestIDType    = reflect.TypeOf(RequestID(""))
+	contextType      = reflect.TypeOf((*context.Context)(nil)).Elem()
+	lookupTypes      = map[reflect.Type]bool{ /* pointer types tryConvert knows how to look up */
+		channelType: true,
+		userType:    true,
+		messageType: true,
+	}
+	sessionTypes = map[reflect.Type]bool{ /* types tryConvert can't resolve without a session */
+		channelType: true,
+		userType:    true,
+		messageType: true,
+		roleIDType:  true,
+		roleType:    true,
+		memberType:  true,
+	}
+	returnTypes = map[reflect.Type]bool{ /* types fn may return */
+		stringType:      true,
+		messageSendType: true,
+		resultsType:     true,
+	}
+	typeNames = map[reflect.Type]string{ /* see typeName */
+		stringType:    "text",
+		anyType:       "any",
+		messageType:   "message link",
+		snowflakeType: "id",
+		roleIDType:    "role",
+		colorType:     "color",
+		locationType:  "time zone",
+		durationType:  "duration",
+		timeType:      "time",
+	}
+	illegalKinds = map[reflect.Kind]bool{
 		reflect.Invalid:       true,
 		reflect.Uintptr:       true,
 		reflect.Array:         true,
@@ -80,7 +477,6 @@ var (
  *
  * TODO
  * have errors be their own type, so it's easier to handle
- * support variadic functions
  * make cmd a interface
  * not be a mess
  */
@@ -90,11 +486,32 @@ var (
 // and errHandler as an optional error handler.
 //
 // fn must have a *discordgo.Session as the first parameter, and *discordgo.MessageCreate
-// as the second. Later parameters are taken as command parameters, and are converted
+// as the second, optionally followed by a context.Context, a RequestID and types
+// registered with InjectType. The context is cancelled once fn returns, or earlier if
+// the register the command is invoked through has a Timeout.
+// Later parameters are taken as command parameters, and are converted
 // automatically upon invocation. Valid parameter types include integer and float types,
-// string, bool and pointers to some discordgo types (User, Channel, Role and Member),
+// string, bool (also spelled yes/no, on/off and such) and pointers to some discordgo
+// types (User, Channel, Role and Member, as well as Message, which is taken as a
+// link to a message in the same server or direct message), *time.Location (from IANA zone names), time.Duration (as in 1h30m),
+// time.Time (see TimeLayouts) and some types defined by this package, such as RoleID.
 // Arrays of supported types are accepted as the last argument of a function, and
-// will behave as if the command was a variadic function.
+// will behave as if the command was a variadic function; fn may as well be an
+// actual variadic function, whose variadic parameter is taken the same way.
+// Structs embedding JSONArg are also accepted as the last argument, taking the
+// rest of the arguments as a JSON object, and so are types implementing ScannedArg
+// and pointers to types implementing ArgParser or encoding.TextUnmarshaler.
+// interface{} parameters take arguments as strings, unless FnCmd.BeforeArg picks
+// another type for them.
+// Parameters of unsupported types are rejected, even if a register the command is
+// later added to has a converter for them; use RegisterConverter to support them.
+//
+// fn may return either nothing, a string, a *discordgo.MessageSend or a
+// []TargetResult, which is replied with as summarized by TargetSummary. Non-empty
+// return values are sent as a reply in the channel the command was invoked in.
+// Any of those may be followed by an error, or fn may return just an error; a
+// non-nil error is reported to the error handler as the invocation's outcome, and
+// no reply is sent.
 //
 func Command(fn interface{}, help string, errHandler CmdErrorHandler) (*FnCmd, error) {
 	val := reflect.ValueOf(fn)
@@ -112,22 +529,46 @@ func Command(fn interface{}, help string, errHandler CmdErrorHandler) (*FnCmd, e
 	if snd := ttype.In(1); snd != messageEventType {
 		return nil, errors.New("Command: fn's second argument is not a pointer to a discordgo.MessageCreate")
 	}
-	var params []reflect.Type
-	for c := 2; c < ttype.NumIn(); c++ {
+	var injected, params []reflect.Type
+	c := 2
+	for ; c < ttype.NumIn() && isInjected(ttype.In(c)); c++ {
+		injected = append(injected, ttype.In(c))
+	}
+	for ; c < ttype.NumIn(); c++ {
 		param := ttype.In(c)
-		if kind := param.Kind(); illegalKinds[kind] {
-			return nil, fmt.Errorf("Command: argument of kind %s not supported", kind)
-		} else if kind == reflect.Slice {
+		elem := param
+		if param.Kind() == reflect.Slice {
 			if c != ttype.NumIn()-1 {
 				return nil, errors.New("Command: slice can only be the last argument in a function")
 			}
-			if illegalKinds[param.Elem().Kind()] {
-				return nil, fmt.Errorf("Command: argument of kind %s not supported", kind)
-			}
+			elem = param.Elem()
+		}
+		if isJSONArg(param) && c != ttype.NumIn()-1 {
+			return nil, errors.New("Command: JSON struct can only be the last argument in a function")
+		}
+		if err := checkParamType(elem); err != nil {
+			return nil, fmt.Errorf("Command: %v", err)
 		}
 		params = append(params, param)
 	}
-	return &FnCmd{Help: help, fn: fn, paramTypes: params, ErrHandler: errHandler}, nil
+	out := ttype.NumOut()
+	if out > 0 && ttype.Out(out-1) == errorType {
+		out--
+	}
+	if out > 1 || (out == 1 && !returnTypes[ttype.Out(0)]) {
+		return nil, fmt.Errorf(
+			"Command: fn may only return a string, a *discordgo.MessageSend or a []TargetResult, optionally followed by an error, not %s",
+			ttype)
+	}
+	return &FnCmd{
+		Help:       help,
+		fn:         fn,
+		injected:   injected,
+		paramTypes: params,
+		params:     make([]paramInfo, len(params)),
+		running:    &sync.Map{},
+		ErrHandler: errHandler,
+	}, nil
 }
 
 //
@@ -175,206 +616,1998 @@ func MustPredicatedCommand(
 	return cmd
 }
 
+//
+// Returns a predicate restricting commands to channels under the category with ID
+// categoryID, so that you don't have to list each of its channels
+//
+func InCategory(categoryID string) CmdPredicate {
+	return CmdPredicate{Category: categoryID}
+}
+
+//
+// Whether the predicate has a custom check. If so, whether a user may invoke the
+// command can't be determined from the predicate's fields alone.
+//
+func (p CmdPredicate) HasCustomCheck() bool {
+	return p.Custom != nil
+}
+
 //
 // Verifies whether the message m satisfies the predicate
 //
 func (p CmdPredicate) Validate(s *discordgo.Session, m *discordgo.MessageCreate) bool {
-	if p.Permissions != 0 {
-		owner, _ := IsOwner(s, m.GuildID, m.Author.ID)
-		perm, _ := MemberHasPermissions(s, m.GuildID, m.Author.ID, p.Permissions)
-		if !owner && !perm {
-			admin, _ := MemberHasPermissions(s, m.GuildID, m.Author.ID, discordgo.PermissionAdministrator)
-			return p.AdministratorOverrides && admin
+	return p.Check(s, m) == nil
+}
+
+//
+// Same as Validate, but returns why the predicate wasn't satisfied; WrongContext if
+// the command was used in the wrong kind of channel (including commands requiring
+// Permissions used in direct messages, where there are no permissions to check),
+// AccessDenied if the user isn't allowed to run it, OnCooldown if they ran it too
+// recently, or an error if the channel couldn't be looked up
+//
+func (p CmdPredicate) Check(s *discordgo.Session, m *discordgo.MessageCreate) error {
+	return p.check(memberPermissions, s, m)
+}
+
+//
+// Same as Check, but permissions are checked with resolve
+//
+func (p CmdPredicate) check(resolve CmdPermissionResolver, s *discordgo.Session, m *discordgo.MessageCreate) error {
+	if err := p.verify(resolve, s, m); err != nil {
+		return err
+	}
+	return p.record(resolve, s, m)
+}
+
+//
+// Same as check, but without recording the invocation towards the cooldown, so that
+// commands can do it once their arguments are converted (see record). Invocations
+// failing on bad arguments thus don't count towards the cooldown either
+//
+func (p CmdPredicate) verify(resolve CmdPermissionResolver, s *discordgo.Session, m *discordgo.MessageCreate) error {
+	if err := p.checkChannel(s, m); err != nil {
+		return err
+	}
+	if p.BotOwnerOnly && !IsBotOwner(m.Author.ID) {
+		return AccessDenied{}
+	}
+	if err := p.checkPermissions(resolve, s, m); err != nil {
+		return err
+	}
+	if p.Custom != nil && !p.Custom(s, m, p) {
+		return AccessDenied{}
+	}
+	if p.Cooldown != nil {
+		if remaining := p.Cooldown.remaining(resolve, s, m); remaining > 0 {
+			return OnCooldown{remaining}
 		}
 	}
-	if p.Custom != nil && p.Custom(s, m, p) {
-		return false
+	return nil
+}
+
+//
+// Records the invocation by the author of m towards the cooldown, if any. It may
+// still fail with OnCooldown, if a concurrent invocation was recorded since verify
+//
+func (p CmdPredicate) record(resolve CmdPermissionResolver, s *discordgo.Session, m *discordgo.MessageCreate) error {
+	if p.Cooldown != nil {
+		return p.Cooldown.check(resolve, s, m)
 	}
-	return true
+	return nil
 }
 
-func (cmd *FnCmd) ErrorHandler() CmdErrorHandler {
-	return cmd.ErrHandler
+func (p CmdPredicate) checkPermissions(resolve CmdPermissionResolver, s *discordgo.Session, m *discordgo.MessageCreate) error {
+	if p.Permissions == 0 {
+		return nil
+	}
+	if m.GuildID == "" {
+		/* There are no permissions to speak of in direct messages */
+		return WrongContext{"in a server"}
+	}
+	perm, err := resolve(s, m, p.Permissions)
+	if err != nil {
+		return err
+	}
+	if perm {
+		return nil
+	}
+	if p.AdministratorOverrides {
+		admin, err := resolve(s, m, discordgo.PermissionAdministrator)
+		if err != nil {
+			return err
+		}
+		if admin {
+			return nil
+		}
+	}
+	return AccessDenied{}
 }
 
 //
-// Invokes the command based on message creation event m with arguments args.
-// Arguments are automatically parsed to their required type; an error is returned
-// if it can't be done. args should not contain the command name as it's first member,
-// but it might be empty if it is required.
+// Same as check, but explains the outcome in words, without counting towards the
+// cooldown
 //
-func (cmd *FnCmd) Invoke(s *discordgo.Session, m *discordgo.MessageCreate, args []string) (err error) {
-	/* Literally copy-pasted, but it needs to be a closure so err is in scope */
-	defer func() {
-		if e := recover(); e != nil {
-			err = fmt.Errorf("Cmd.Invoke: %v", e)
+func (p CmdPredicate) explain(
+	resolve CmdPermissionResolver,
+	s *discordgo.Session,
+	m *discordgo.MessageCreate,
+) (allowed bool, reason string) {
+	if err := p.checkChannel(s, m); err != nil {
+		if wrong, ok := err.(WrongContext); ok {
+			return false, "it can only be used " + wrong.Where
 		}
-	}()
-
-	if !cmd.Predicate.Validate(s, m) {
-		err = AccessDenied{}
-		return
+		return false, "the channel couldn't be looked up: " + err.Error()
 	}
-
-	expectLen := len(cmd.paramTypes)
-	actualLen := len(args)
-	sliceReceiver := false
-	if expectLen > 0 {
-		sliceReceiver = cmd.paramTypes[expectLen-1].Kind() == reflect.Slice
+	if p.BotOwnerOnly && !IsBotOwner(m.Author.ID) {
+		return false, "it can only be used by the bot's owners"
 	}
-	if sliceReceiver {
-		expectLen--
+	switch err := p.checkPermissions(resolve, s, m); {
+	case err == nil:
+	case m.GuildID == "":
+		return false, "it requires permissions, so it can't be used in direct messages"
+	case err != (AccessDenied{}):
+		return false, "permissions couldn't be checked: " + err.Error()
+	default:
+		return false, "it requires any of these permissions: " + strings.Join(PermissionNames(p.Permissions), ", ")
 	}
-	if actualLen < expectLen || (!sliceReceiver && actualLen > expectLen) {
-		err = ArgCountMismatch{expectLen, actualLen}
-		return
+	if p.Custom != nil && !p.Custom(s, m, p) {
+		return false, "it was denied by the command's own check"
 	}
+	if p.Cooldown != nil {
+		if remaining := p.Cooldown.remaining(resolve, s, m); remaining > 0 {
+			return false, "it's on cooldown for another " + remaining.Round(time.Second).String()
+		}
+	}
+	return true, "all of its requirements are met"
+}
 
-	var vals []reflect.Value
-	vals = append(vals, reflect.ValueOf(s), reflect.ValueOf(m))
-	for c := 0; c < len(cmd.paramTypes); c++ {
-		/* Need to declare this manually, := shadows err on the tryConvert call */
-		var val reflect.Value
+/* Default CmdPermissionResolver, failed lookups deny access */
+func memberPermissions(s *discordgo.Session, m *discordgo.MessageCreate, required int) (bool, error) {
+	/* The owner may do anything, even if their member can't be looked up */
+	if owner, _ := IsOwner(s, m.GuildID, m.Author.ID); owner {
+		return true, nil
+	}
+	perm, _ := MemberHasPermissions(s, m.GuildID, m.Author.ID, required)
+	return perm, nil
+}
 
-		expect := cmd.paramTypes[c]
-		if expect.Kind() == reflect.Slice {
-			sliceType := expect.Elem()
-			slice := reflect.New(expect).Elem()
-			for ; c < len(args); c++ {
-				val, err = tryConvert(s, sliceType, args[c])
-				if err != nil {
-					return
-				}
-				slice = reflect.Append(slice, val)
-			}
-			val = slice
-		} else {
-			val, err = tryConvert(s, expect, args[c])
+func (p CmdPredicate) checkChannel(s *discordgo.Session, m *discordgo.MessageCreate) error {
+	switch {
+	case p.Scope == GuildOnly && m.GuildID == "":
+		return WrongContext{"in a server"}
+	case p.Scope == DMOnly && m.GuildID != "":
+		return WrongContext{"in direct messages"}
+	}
+	if !p.ThreadOnly && !p.NoThreads && !p.ForumOnly && p.Category == "" {
+		return nil
+	}
+	channel, err := stateChannel(s, m.ChannelID)
+	if err != nil {
+		return err
+	}
+	thread := isThread(channel.Type)
+	switch {
+	case p.NoThreads && thread:
+		return WrongContext{"outside of threads"}
+	case p.ThreadOnly && !thread:
+		return WrongContext{"in a thread"}
+	case p.ForumOnly:
+		if !thread {
+			return WrongContext{"in a forum post"}
 		}
-
+		parent, err := stateChannel(s, channel.ParentID)
 		if err != nil {
-			return
+			return err
+		}
+		if parent.Type != channelTypeGuildForum {
+			return WrongContext{"in a forum post"}
 		}
-
-		vals = append(vals, val)
 	}
-
-	reflect.ValueOf(cmd.fn).Call(vals)
-	return
+	if p.Category != "" {
+		categoryID := channel.ParentID
+		if thread {
+			/* Threads are under a channel, which is the one under the category */
+			parent, err := stateChannel(s, channel.ParentID)
+			if err != nil {
+				return err
+			}
+			categoryID = parent.ParentID
+		}
+		if categoryID != p.Category {
+			where := "in the category " + p.Category
+			if category, err := stateChannel(s, p.Category); err == nil {
+				where = "in the " + category.Name + " category"
+			}
+			return WrongContext{where}
+		}
+	}
+	return nil
 }
 
 //
-// Returns the canonical name of a command
+// Returns a copy of the command with its leading parameters bound to args, which
+// are converted right away. The resulting command takes len(args) less arguments
+// from the user, so that you can roll := dice.Bind("6").
+// Since no session is available at bind time, parameters that need to be looked
+// up (pointers to discordgo types) can't be bound, neither can the trailing slice.
 //
-func (reg *CmdRegistry) Canon(name string) string {
-	canon := reg.Aliases[name]
-	if canon != "" {
-		return canon
+func (cmd *FnCmd) Bind(args ...string) (*FnCmd, error) {
+	bindable := len(cmd.paramTypes)
+	if bindable > 0 && cmd.paramTypes[bindable-1].Kind() == reflect.Slice {
+		bindable--
 	}
-	return name
+	if len(args) > bindable {
+		return nil, fmt.Errorf("FnCmd.Bind: can bind at most %d arguments, got %d", bindable, len(args))
+	}
+	bound := append([]reflect.Value{}, cmd.bound...)
+	for c, arg := range args {
+		if word := cmd.params[c].keyword; word != "" {
+			if arg != word && arg != "" {
+				return nil, UnmarshalError{Why: fmt.Errorf("expected %q but got %q", word, arg)}
+			}
+			bound = append(bound, reflect.ValueOf(arg == word))
+			continue
+		}
+		val, err := tryConvert(nil, nil, cmd.paramTypes[c], arg)
+		if err != nil {
+			return nil, err
+		}
+		bound = append(bound, val)
+	}
+	ret := *cmd
+	ret.paramTypes = cmd.paramTypes[len(args):]
+	ret.params = cmd.params[len(args):]
+	ret.bound = bound
+	return &ret, nil
 }
 
 //
-// Returns a commend in the register, or nil if the command doesn't exist
-// name might be a canon name or an alias
+// Makes the bool parameter at index param (counting from the first parameter taken
+// from the user) a literal keyword: it's true if word is given in its place, and
+// false if it's left out, so that a command can tell "!list all" from "!list"
+// without it being a separate command. Any other argument where the keyword was
+// expected is an error.
 //
-func (reg *CmdRegistry) Get(name string) Cmd {
-	return reg.Cmds[reg.Canon(name)]
+func (cmd *FnCmd) Keyword(param int, word string) error {
+	if err := cmd.checkFlagParam(param); err != nil {
+		return fmt.Errorf("FnCmd.Keyword: %v", err)
+	}
+	if word == "" {
+		return errors.New("FnCmd.Keyword: empty keyword")
+	}
+	params := append([]paramInfo{}, cmd.params...)
+	params[param].keyword = word
+	cmd.params = params
+	return nil
 }
 
-func (reg *CmdRegistry) Add(name string, cmd Cmd) error {
-	if cur := reg.Get(name); cur != nil {
-		return fmt.Errorf("CmdRegistry.Add: command %s already exists in register", name)
+//
+// Makes the bool parameter at index param a flag set by letter, given after the
+// command's other arguments as -letter, and possibly combined with other flags as
+// in "!build -xvf". Parameters with a shorthand aren't taken positionally, and are
+// false unless their flag is given.
+//
+func (cmd *FnCmd) Shorthand(param int, letter rune) error {
+	if err := cmd.checkFlagParam(param); err != nil {
+		return fmt.Errorf("FnCmd.Shorthand: %v", err)
+	}
+	if !unicode.IsLetter(letter) {
+		return fmt.Errorf("FnCmd.Shorthand: shorthand %q is not a letter", letter)
+	}
+	if cmd.shorthandParam(letter) >= 0 {
+		return fmt.Errorf("FnCmd.Shorthand: shorthand %q already in use", letter)
 	}
-	reg.Cmds[name] = cmd
+	params := append([]paramInfo{}, cmd.params...)
+	params[param].shorthand = letter
+	cmd.params = params
 	return nil
 }
 
-func (reg *CmdRegistry) Alias(name string, dest string) error {
-	if cmd := reg.Get(dest); cmd == nil {
-		return fmt.Errorf("%s doesn't exist in register", name)
+//
+// Limits the argument given for the parameter at index param to max runes, so that
+// oversized input (say, a novel pasted as a reason) is rejected with ArgTooLong
+// before reaching the function. For a trailing slice, each element is limited.
+//
+func (cmd *FnCmd) MaxLength(param int, max int) error {
+	if param < 0 || param >= len(cmd.paramTypes) {
+		return fmt.Errorf("FnCmd.MaxLength: no parameter %d", param)
 	}
-	if cmd := reg.Get(name); cmd != nil {
-		return fmt.Errorf("%s already exists in register", name)
+	if max <= 0 {
+		return fmt.Errorf("FnCmd.MaxLength: invalid length %d", max)
 	}
-	reg.Aliases[name] = dest
+	params := append([]paramInfo{}, cmd.params...)
+	params[param].maxLength = max
+	cmd.params = params
 	return nil
 }
 
 //
-// Handles commands in the context of this register
-// pfx represents a prefix string for prefixed commands
-// errHandler is an optional error handler. If non-nil, it will be called when a command
-// returns an error when executing. It can be overriden on a per-command basis
+// Makes the parameter at index param, along with every parameter after it that's
+// taken positionally, optional: if there are fewer arguments than the command's
+// parameters, the ones left over are given their zero value (so nil for pointers)
+// instead of failing with ArgCountMismatch, as in "!poll <question> [duration]".
+// Arguments are assigned in order, so optional parameters are filled in before
+// later ones.
 //
-func (reg *CmdRegistry) Handle(
-	s *discordgo.Session,
-	msg *discordgo.MessageCreate,
-	pfx string,
-	errHandler CmdErrorHandler,
-) {
-	if msg.Author.ID == s.State.User.ID {
-		return
+func (cmd *FnCmd) Optional(param int) error {
+	if param < 0 || param >= len(cmd.paramTypes) || !cmd.positional(param) {
+		return fmt.Errorf("FnCmd.Optional: no positional parameter %d", param)
 	}
-	if strings.HasPrefix(msg.Content, pfx) {
-		args := strings.Split(msg.Content, " ") /* FIXME this breaks args with spaces */
-		str := args[0]
-		str = strings.Replace(str, pfx, "", 1)
-		cmd := reg.Get(str)
-		if cmd != nil {
-			err := cmd.Invoke(s, msg, args[1:])
-			handler := errHandler
-			if cmdHandler := cmd.ErrorHandler(); cmdHandler != nil {
-				handler = cmdHandler
-			}
-			if err != nil && handler != nil {
-				handler(s, msg, err)
-			}
+	params := append([]paramInfo{}, cmd.params...)
+	for c := param; c < len(params); c++ {
+		if cmd.positional(c) {
+			params[c].optional = true
 		}
 	}
+	cmd.params = params
+	return nil
 }
 
 //
-// Returns a handler function, suitable to be used with discordgo.Session.AddHandler
-// pfx represents a prefix string for prefixed commands
-// errHandler is an optional error handler. If non-nil, it will be called when a command
-// returns an error when executing. It can be overriden on a per-command basis
+// Makes the last parameter, which must be a string, take the rest of the message,
+// as in "!echo the rest of this line", without it having to be quoted. It gets the
+// text as typed, quotes, backslashes and whitespace included, up to any trailing
+// shorthands. Where the message's text can't be told apart, as with custom
+// tokenizers, the arguments are joined with single spaces instead
 //
-func (reg *CmdRegistry) Handler(
-	pfx string,
-	errHandler CmdErrorHandler,
-) func(*discordgo.Session, *discordgo.MessageCreate) {
-	return func(s *discordgo.Session, msg *discordgo.MessageCreate) {
-		reg.Handle(s, msg, pfx, errHandler)
+func (cmd *FnCmd) RestOfLine() error {
+	last := len(cmd.paramTypes) - 1
+	if last < 0 || !cmd.positional(last) || cmd.paramTypes[last].Kind() != reflect.String {
+		return errors.New("FnCmd.RestOfLine: last parameter is not a string")
 	}
+	params := append([]paramInfo{}, cmd.params...)
+	params[last].rest = true
+	cmd.params = params
+	return nil
 }
 
 //
-// Creates an empty command register
+// Whether the parameter at index param takes a single argument at its position,
+// rather than being a keyword, a shorthand, or taking the remaining arguments
 //
-func Registry() *CmdRegistry {
-	return &CmdRegistry{
-		Cmds:    map[string]Cmd{},
-		Aliases: map[string]string{},
-	}
+func (cmd *FnCmd) positional(param int) bool {
+	ttype, info := cmd.paramTypes[param], cmd.params[param]
+	return info.keyword == "" && info.shorthand == 0 && ttype.Kind() != reflect.Slice && !isJSONArg(ttype)
 }
 
 //
-// Attempts to parse str into the required type ttype, errors if it can't be done
+// Converts str for the parameter at index param, after checking its length
 //
-func tryConvert(s *discordgo.Session, ttype reflect.Type, str string) (val reflect.Value, err error) {
-	defer func() {
-		if e := recover(); e != nil {
-			err = UnmarshalError{fmt.Errorf("tryConvert: %v", e)}
+func (cmd *FnCmd) convert(
+	inv *invocation,
+	s *discordgo.Session,
+	m *discordgo.MessageCreate,
+	param int,
+	ttype reflect.Type,
+	str string,
+) (reflect.Value, error) {
+	if max := cmd.params[param].maxLength; max > 0 {
+		if length := utf8.RuneCountInString(str); length > max {
+			return reflect.Value{}, ArgTooLong{param, max, length}
 		}
-	}()
-	switch ttype.Kind() {
-	case reflect.String:
-		val = reflect.ValueOf(str)
-	case reflect.Ptr:
-		/*
-		 * For those, we first consider the string as a mention
-		 * failing that, we look it up as an id, and if it fails,
+	}
+	return inv.reg.convert(s, m, ttype, str)
+}
+
+//
+// Reports err, from parsing raw as the argument at index a, as an ArgParseError if
+// it's an UnmarshalError
+//
+func argError(inv *invocation, a int, raw string, err error) error {
+	if _, ok := err.(UnmarshalError); !ok {
+		return err
+	}
+	return ArgParseError{Command: inv.name, ArgIndex: a, Raw: raw, Err: err}
+}
+
+//
+// Returns the type the argument raw for the parameter at index param should be
+// converted to, as chosen by BeforeArg. interface{} parameters take strings unless
+// BeforeArg says otherwise
+//
+func (cmd *FnCmd) argType(param int, parsed []reflect.Value, raw string) (reflect.Type, error) {
+	ttype := cmd.paramTypes[param]
+	if cmd.BeforeArg != nil {
+		chosen, err := cmd.BeforeArg(param, parsed, raw)
+		if err != nil {
+			if _, ok := err.(UnmarshalError); !ok {
+				err = UnmarshalError{Why: err}
+			}
+			return nil, err
+		}
+		if chosen != nil {
+			if !chosen.AssignableTo(ttype) {
+				return nil, UnmarshalError{Why: fmt.Errorf("BeforeArg: %s isn't assignable to %s", chosen, ttype)}
+			}
+			if err = checkParamType(chosen); err != nil {
+				return nil, UnmarshalError{Why: fmt.Errorf("BeforeArg: %v", err)}
+			}
+			ttype = chosen
+		}
+	}
+	if ttype == anyType {
+		ttype = stringType
+	}
+	return ttype, nil
+}
+
+//
+// Errors if the parameter at index param can't be made a keyword or shorthand
+//
+func (cmd *FnCmd) checkFlagParam(param int) error {
+	if param < 0 || param >= len(cmd.paramTypes) {
+		return fmt.Errorf("no parameter %d", param)
+	}
+	if kind := cmd.paramTypes[param].Kind(); kind != reflect.Bool {
+		return fmt.Errorf("expected parameter of kind Bool, got %s", kind)
+	}
+	if info := cmd.params[param]; info.keyword != "" || info.shorthand != 0 {
+		return fmt.Errorf("parameter %d is already a keyword or shorthand", param)
+	}
+	return nil
+}
+
+//
+// Returns the index of the parameter with shorthand letter, or -1 if there's none
+//
+func (cmd *FnCmd) shorthandParam(letter rune) int {
+	for c, info := range cmd.params {
+		if info.shorthand == letter {
+			return c
+		}
+	}
+	return -1
+}
+
+//
+// Strips trailing shorthand flags off args, returning the remaining arguments and
+// which parameters were set. Arguments that aren't made up of known shorthands,
+// such as negative numbers, are left alone.
+//
+func (cmd *FnCmd) parseFlags(args []string) ([]string, map[int]bool) {
+	set := map[int]bool{}
+	for len(args) > 0 {
+		arg := args[len(args)-1]
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		var params []int
+		for _, letter := range arg[1:] {
+			param := cmd.shorthandParam(letter)
+			if param < 0 {
+				return args, set
+			}
+			params = append(params, param)
+		}
+		for _, param := range params {
+			set[param] = true
+		}
+		args = args[:len(args)-1]
+	}
+	return args, set
+}
+
+//
+// Returns how many arguments the command requires, and how many more it may
+// optionally take, not counting the trailing slice
+//
+func (cmd *FnCmd) arity() (required, optional int) {
+	for c, ttype := range cmd.paramTypes {
+		switch {
+		case cmd.params[c].shorthand != 0:
+		case cmd.params[c].keyword != "", cmd.params[c].optional:
+			optional++
+		case ttype.Kind() != reflect.Slice:
+			required++
+		}
+	}
+	return
+}
+
+//
+// Returns a copy of the command's predicate, so that external code (i.e. a dashboard)
+// can tell who is able to run it without actually invoking it.
+// See CmdPredicate.HasCustomCheck
+//
+func (cmd *FnCmd) PredicateInfo() CmdPredicate {
+	return cmd.Predicate
+}
+
+func (cmd *FnCmd) ErrorHandler() CmdErrorHandler {
+	return cmd.ErrHandler
+}
+
+//
+// Invokes the command based on message creation event m with arguments args.
+// Arguments are automatically parsed to their required type; an error is returned
+// if it can't be done. args should not contain the command name as it's first member,
+// but it might be empty if it is required.
+// If the function returns a reply, it is sent to the channel m was sent in.
+//
+func (cmd *FnCmd) Invoke(s *discordgo.Session, m *discordgo.MessageCreate, args []string) error {
+	return invokeStandalone(cmd, s, m, args)
+}
+
+//
+// Invokes cmd outside of a register, sending its reply directly
+//
+func invokeStandalone(cmd replyingCmd, s *discordgo.Session, m *discordgo.MessageCreate, args []string) error {
+	reply, err := cmd.invokeReply(&invocation{id: newRequestID()}, s, m, args)
+	if err == nil && reply != nil {
+		_, err = s.ChannelMessageSendComplex(m.ChannelID, reply)
+	}
+	return err
+}
+
+func (cmd *FnCmd) invokeReply(
+	inv *invocation,
+	s *discordgo.Session,
+	m *discordgo.MessageCreate,
+	args []string,
+) (reply *discordgo.MessageSend, err error) {
+	/* Literally copy-pasted, but it needs to be a closure so err is in scope */
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("Cmd.Invoke: %v", e)
+		}
+	}()
+
+	if inv.reg.isHelpToken(args) {
+		/* Asking for help shouldn't count towards the cooldown */
+		pred := cmd.Predicate
+		pred.Cooldown = nil
+		if err = pred.check(inv.reg.permissions(), s, m); err == nil {
+			reply = &discordgo.MessageSend{Content: cmd.usage(inv.name)}
+		}
+		return
+	}
+	if err = cmd.Predicate.verify(inv.reg.permissions(), s, m); err != nil {
+		return
+	}
+	inv.afterParse(func() error {
+		return cmd.Predicate.record(inv.reg.permissions(), s, m)
+	})
+	var cacheKey string
+	if cmd.Cache != nil {
+		/* Flags change the reply too, so the key is made before they're parsed */
+		cacheKey = cacheKeyFor(cmd, inv.name, args)
+		var hit bool
+		if reply, hit = cmd.Cache.get(cacheKey); hit {
+			/* These arguments were converted fine before, so it counts */
+			if err = inv.parsed(); err != nil {
+				reply = nil
+			}
+			return
+		}
+	}
+
+	typed := args /* as they came, flags included, see rawArgs */
+	args, flags := cmd.parseFlags(args)
+	/* Whether the last parameter takes all remaining arguments */
+	sliceReceiver := false
+	if n := len(cmd.paramTypes); n > 0 {
+		last := cmd.paramTypes[n-1]
+		sliceReceiver = last.Kind() == reflect.Slice || isJSONArg(last) || cmd.params[n-1].rest
+	}
+	required, optional := cmd.arity()
+	if len(args) < required || (!sliceReceiver && len(args) > required+optional) {
+		expect := required
+		if len(args) > required {
+			expect += optional
+		}
+		err = ArgCountMismatch{expect, len(args)}
+		return
+	}
+
+	var vals []reflect.Value
+	vals = append(vals, reflect.ValueOf(s), reflect.ValueOf(m))
+	for _, ttype := range cmd.injected {
+		var val reflect.Value
+		if ttype == contextType {
+			ctx, cancel := inv.context()
+			defer cancel()
+			val = reflect.ValueOf(&ctx).Elem()
+		} else if val, err = inv.inject(ttype); err != nil {
+			return
+		}
+		vals = append(vals, val)
+	}
+	vals = append(vals, cmd.bound...)
+	parsed := len(vals) /* where values of the parameters being converted start */
+	a := 0              /* index of the next argument to consume */
+	for c := 0; c < len(cmd.paramTypes); c++ {
+		/* Need to declare this manually, := shadows err on the tryConvert call */
+		var val reflect.Value
+
+		expect := cmd.paramTypes[c]
+		if cmd.params[c].shorthand != 0 {
+			vals = append(vals, reflect.ValueOf(flags[c]))
+			continue
+		}
+		if word := cmd.params[c].keyword; word != "" {
+			optional--
+			present := a < len(args) && args[a] == word
+			if present {
+				a++
+			} else if !sliceReceiver && len(args)-a > required+optional {
+				/* There's an argument to spare, so it must've been meant for us */
+				err = UnmarshalError{Why: fmt.Errorf("expected %q but got %q", word, args[a])}
+				return
+			}
+			vals = append(vals, reflect.ValueOf(present))
+			continue
+		}
+		if expect.Kind() == reflect.Slice {
+			sliceType := expect.Elem()
+			slice := reflect.New(expect).Elem()
+			var errs joinedError
+			for ; a < len(args); a++ {
+				val, err = cmd.convert(inv, s, m, c, sliceType, args[a])
+				if err != nil {
+					if !cmd.AggregateErrors {
+						err = argError(inv, a, args[a], err)
+						return
+					}
+					if uerr, ok := err.(UnmarshalError); ok {
+						err = uerr.Why
+					}
+					errs = append(errs, err)
+					continue
+				}
+				slice = reflect.Append(slice, val)
+			}
+			if len(errs) > 0 {
+				err = UnmarshalError{Why: errs}
+				return
+			}
+			val = slice
+		} else if isJSONArg(expect) {
+			raw := strings.Join(args[a:], " ")
+			if val, err = cmd.convert(inv, s, m, c, expect, raw); err != nil {
+				err = argError(inv, a, raw, err)
+			}
+			a = len(args)
+		} else if cmd.params[c].optional && len(args)-a <= required {
+			/* Whatever is left is needed by required parameters */
+			optional--
+			val = reflect.Zero(expect)
+		} else {
+			raw, next := args[a], a+1
+			if cmd.params[c].rest {
+				raw, next = rawArgs(m.Content, typed, a, len(args)), len(args)
+			}
+			if expect, err = cmd.argType(c, vals[parsed:], raw); err == nil {
+				val, err = cmd.convert(inv, s, m, c, expect, raw)
+			}
+			if err != nil {
+				err = argError(inv, a, raw, err)
+				return
+			}
+			a = next
+			if cmd.params[c].optional {
+				optional--
+			} else {
+				required--
+			}
+		}
+
+		if err != nil {
+			return
+		}
+
+		vals = append(vals, val)
+	}
+
+	if err = inv.parsed(); err != nil {
+		return
+	}
+	if inv.reg != nil && inv.reg.auditHook != nil {
+		resolved := make([]interface{}, 0, len(vals))
+		for _, val := range vals[2+len(cmd.injected):] {
+			resolved = append(resolved, val.Interface())
+		}
+		inv.reg.auditHook(s, m, inv.id, inv.name, resolved)
+	}
+	if cmd.Exclusive {
+		if _, running := cmd.running.LoadOrStore(m.Author.ID, true); running {
+			err = AlreadyRunning{}
+			return
+		}
+		defer cmd.running.Delete(m.Author.ID)
+	}
+	if cmd.LongRunning && m.GuildID != "" {
+		defer startTyping(s, m.ChannelID)()
+	}
+	var out []reflect.Value
+	if fn := reflect.ValueOf(cmd.fn); fn.Type().IsVariadic() {
+		out = fn.CallSlice(vals)
+	} else {
+		out = fn.Call(vals)
+	}
+	if n := len(out); n > 0 && out[n-1].Type() == errorType {
+		if !out[n-1].IsNil() {
+			err = out[n-1].Interface().(error)
+			return
+		}
+		out = out[:n-1]
+	}
+	if len(out) > 0 {
+		switch ret := out[0].Interface().(type) {
+		case string:
+			if ret != "" {
+				reply = &discordgo.MessageSend{Content: ret}
+			}
+		case *discordgo.MessageSend:
+			reply = ret
+		case []TargetResult:
+			reply = targetReply(ret)
+		}
+	}
+	if cmd.Cache != nil {
+		cmd.Cache.put(cacheKey, inv.name, reply)
+	}
+	return
+}
+
+//
+// Returns the types of the command's parameters, the ones users supply, in order.
+// Parameters fixed by Bind aren't included
+//
+func (cmd *FnCmd) Signature() []reflect.Type {
+	return append([]reflect.Type{}, cmd.paramTypes...)
+}
+
+//
+// Formats the command's parameters as invoked by name, with friendly names for
+// their types, i.e.
+//
+//	ban <user> <text...>
+//
+// Trailing slices and RestOfLine parameters end with an ellipsis, and keywords,
+// shorthands and optional parameters (see Keyword, Shorthand and Optional) are shown
+// in brackets.
+//
+func (cmd *FnCmd) Usage(name string) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for c, ttype := range cmd.paramTypes {
+		if word := cmd.params[c].keyword; word != "" {
+			fmt.Fprintf(&b, " [%s]", word)
+			continue
+		}
+		if letter := cmd.params[c].shorthand; letter != 0 {
+			fmt.Fprintf(&b, " [-%c]", letter)
+			continue
+		}
+		variadic := ""
+		if ttype.Kind() == reflect.Slice {
+			ttype = ttype.Elem()
+			variadic = "..."
+		} else if cmd.params[c].rest {
+			variadic = "..."
+		}
+		if cmd.params[c].optional {
+			fmt.Fprintf(&b, " [%s]", typeName(ttype))
+			continue
+		}
+		fmt.Fprintf(&b, " <%s%s>", typeName(ttype), variadic)
+	}
+	return b.String()
+}
+
+//
+// Formats the command's usage and help string, i.e.
+//
+//	`roll <number> <text...>`
+//	Rolls dice
+//
+func (cmd *FnCmd) usage(name string) string {
+	usage := "`" + cmd.Usage(name) + "`"
+	if cmd.Help != "" {
+		usage += "\n" + cmd.Help
+	}
+	return usage
+}
+
+//
+// Returns how a parameter of type ttype is shown in usage strings
+//
+func typeName(ttype reflect.Type) string {
+	if name, ok := typeNames[ttype]; ok {
+		return name
+	}
+	switch kind := ttype.Kind(); {
+	case kind >= reflect.Int && kind <= reflect.Float64:
+		return "number"
+	case isJSONArg(ttype):
+		return "json"
+	case kind == reflect.Ptr:
+		ttype = ttype.Elem()
+	}
+	return strings.ToLower(ttype.Name())
+}
+
+//
+// Returns the canonical name of a command
+//
+func (reg *CmdRegistry) Canon(name string) string {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	return reg.canon(name)
+}
+
+func (reg *CmdRegistry) canon(name string) string {
+	key := reg.fold(name)
+	canon := reg.Aliases[key]
+	if canon != "" {
+		return canon
+	}
+	if reg.Cmds[key] == nil && reg.parent != nil {
+		return reg.parent.Canon(name)
+	}
+	return key
+}
+
+//
+// Returns the key name is stored under, see CaseInsensitive
+//
+func (reg *CmdRegistry) fold(name string) string {
+	if reg.CaseInsensitive {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+//
+// Returns a commend in the register, or nil if the command doesn't exist
+// name might be a canon name or an alias
+//
+func (reg *CmdRegistry) Get(name string) Cmd {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	return reg.get(name)
+}
+
+//
+// Same as Get, but also returns the canonical name, both looked up at once
+//
+func (reg *CmdRegistry) resolve(name string) (Cmd, string) {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	return reg.get(name), reg.canon(name)
+}
+
+func (reg *CmdRegistry) get(name string) Cmd {
+	canon := reg.canon(name)
+	if cmd := reg.Cmds[canon]; cmd != nil || reg.parent == nil {
+		return cmd
+	}
+	return reg.parent.Get(canon)
+}
+
+//
+// Whether name is a command or alias of this register, disregarding its parent
+//
+func (reg *CmdRegistry) defines(name string) bool {
+	name = reg.fold(name)
+	return reg.Cmds[name] != nil || reg.Aliases[name] != ""
+}
+
+//
+// Adds cmd to the register under name. It's safe to call concurrently with commands
+// being dispatched, including from within a command; see MutableView for exposing
+// it to users. In an overlay, cmd may override a command of the parent register.
+//
+func (reg *CmdRegistry) Add(name string, cmd Cmd) error {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if reg.defines(name) {
+		return fmt.Errorf("CmdRegistry.Add: command %s already exists in register", name)
+	}
+	reg.Cmds[reg.fold(name)] = cmd
+	return nil
+}
+
+//
+// Makes name an alias of command dest. Like Add, it's safe to call at any time.
+//
+func (reg *CmdRegistry) Alias(name string, dest string) error {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if cmd := reg.get(dest); cmd == nil {
+		return fmt.Errorf("%s doesn't exist in register", name)
+	}
+	if reg.defines(name) {
+		return fmt.Errorf("%s already exists in register", name)
+	}
+	reg.Aliases[reg.fold(name)] = reg.fold(dest)
+	return nil
+}
+
+//
+// Removes the command name (which may be an alias) from the register, along with
+// every alias pointing to it, i.e. to unload a module of commands. Commands of the
+// parent register of an overlay can't be removed through the overlay.
+//
+func (reg *CmdRegistry) Remove(name string) error {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	canon := reg.canon(name)
+	if reg.Cmds[canon] == nil {
+		return fmt.Errorf("CmdRegistry.Remove: %s isn't a command in register", name)
+	}
+	delete(reg.Cmds, canon)
+	for alias, dest := range reg.Aliases {
+		if dest == canon {
+			delete(reg.Aliases, alias)
+		}
+	}
+	reg.stats.Delete(canon)
+	return nil
+}
+
+//
+// Removes the alias name, leaving the command it points to alone. Errors if name
+// isn't an alias in the register
+//
+func (reg *CmdRegistry) Unalias(name string) error {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if reg.Aliases[reg.fold(name)] == "" {
+		return fmt.Errorf("CmdRegistry.Unalias: %s isn't an alias in register", name)
+	}
+	delete(reg.Aliases, reg.fold(name))
+	return nil
+}
+
+//
+// Adds the commands and aliases of other to the register, so that features can
+// each build their own register to be merged into the bot's. If any of their names
+// is already taken, nothing is merged and MergeConflict lists the names.
+// Stats and configuration of other aren't merged.
+//
+func (reg *CmdRegistry) Merge(other *CmdRegistry) error {
+	if other == reg {
+		return errors.New("CmdRegistry.Merge: can't merge register into itself")
+	}
+	/*
+	 * Copy other first rather than holding both locks, or merging two registers
+	 * into each other at once would deadlock
+	 */
+	other.lock.RLock()
+	cmds := make(map[string]Cmd, len(other.Cmds))
+	for name, cmd := range other.Cmds {
+		cmds[name] = cmd
+	}
+	aliases := make(map[string]string, len(other.Aliases))
+	for name, dest := range other.Aliases {
+		aliases[name] = dest
+	}
+	other.lock.RUnlock()
+
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	var conflicts []string
+	for name := range cmds {
+		if reg.defines(name) {
+			conflicts = append(conflicts, name)
+		}
+	}
+	for name := range aliases {
+		if reg.defines(name) {
+			conflicts = append(conflicts, name)
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return MergeConflict{conflicts}
+	}
+	for name, cmd := range cmds {
+		reg.Cmds[reg.fold(name)] = cmd
+	}
+	for name, dest := range aliases {
+		reg.Aliases[reg.fold(name)] = reg.fold(dest)
+	}
+	return nil
+}
+
+//
+// Creates a register layered on top of reg, for commands specific to a guild on
+// top of a shared set. Commands and aliases are looked up in the overlay first, and
+// then in reg, so the overlay can add commands as well as override reg's. Changes
+// to reg are seen by the overlay, but its configuration (Tokenizer, Webhooks and so
+// on, as well as hooks) is copied at creation.
+//
+func (reg *CmdRegistry) Overlay() *CmdRegistry {
+	child := Registry()
+	child.parent = reg
+	child.Tokenizer = reg.Tokenizer
+	child.MaxContentLength = reg.MaxContentLength
+	child.Webhooks = reg.Webhooks
+	child.Converters = reg.Converters
+	child.MaxPipeline = reg.MaxPipeline
+	child.HelpTokens = reg.HelpTokens
+	child.SuppressMentions = reg.SuppressMentions
+	child.Deps = reg.Deps
+	child.StateWait = reg.StateWait
+	child.FileThreshold = reg.FileThreshold
+	child.WarmGuilds = reg.WarmGuilds
+	child.NotFoundMessages = reg.NotFoundMessages
+	child.Colors = reg.Colors
+	child.CaseInsensitive = reg.CaseInsensitive
+	child.MentionPrefix = reg.MentionPrefix
+	child.ReportUnknown = reg.ReportUnknown
+	child.GlobalPredicate = reg.GlobalPredicate
+	child.Observer = reg.Observer
+	child.Logf = reg.Logf
+	child.BaseContext = reg.BaseContext
+	child.Timeout = reg.Timeout
+	child.auditHook = reg.auditHook
+	child.permResolver = reg.permResolver
+	child.middleware = reg.middleware
+	return child
+}
+
+//
+// Returns every command and alias reachable through the register, including its
+// parent's
+//
+func (reg *CmdRegistry) effective() (cmds map[string]Cmd, aliases map[string]string) {
+	cmds, aliases = map[string]Cmd{}, map[string]string{}
+	if reg.parent != nil {
+		cmds, aliases = reg.parent.effective()
+	}
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	for name, cmd := range reg.Cmds {
+		cmds[name] = cmd
+		delete(aliases, name)
+	}
+	for alias, dest := range reg.Aliases {
+		aliases[alias] = dest
+		delete(cmds, alias)
+	}
+	return
+}
+
+//
+// Returns a view of the register allowing it to be changed only by invocations
+// satisfying guard, for commands that let users manage commands or aliases, i.e.
+//
+//	view := reg.MutableView(CmdPredicate{Permissions: discordgo.PermissionManageServer})
+//	reg.Add("alias", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, name, dest string) string {
+//		if err := view.Alias(s, m, name, dest); err != nil {
+//			return err.Error()
+//		}
+//		return "Done!"
+//	}, "", nil))
+//
+func (reg *CmdRegistry) MutableView(guard CmdPredicate) *CmdMutableView {
+	return &CmdMutableView{reg, guard}
+}
+
+//
+// Handles commands in the context of this register
+// pfx represents a prefix string for prefixed commands
+// errHandler is an optional error handler. If non-nil, it will be called when a command
+// returns an error when executing. It can be overriden on a per-command basis
+//
+func (reg *CmdRegistry) Handle(
+	s *discordgo.Session,
+	msg *discordgo.MessageCreate,
+	pfx string,
+	errHandler CmdErrorHandler,
+) {
+	reg.HandleMulti(s, msg, []string{pfx}, errHandler)
+}
+
+//
+// Same as Handle, but commands may be prefixed by any of prefixes, i.e. both ! and ?.
+// When several of them match, the longest wins, so that !! commands aren't shadowed
+// by !
+//
+func (reg *CmdRegistry) HandleMulti(
+	s *discordgo.Session,
+	msg *discordgo.MessageCreate,
+	prefixes []string,
+	errHandler CmdErrorHandler,
+) {
+	id := newRequestID()
+	cmd, _, err := reg.dispatch(id, s, msg, prefixes)
+	routeError(id, s, msg, cmd, err, errHandler)
+}
+
+//
+// Calls cmd's error handler, or errHandler if it doesn't have one, if err is non-nil.
+// The handler gets err as a RequestError of request id. cmd may be nil
+//
+func routeError(
+	id RequestID,
+	s *discordgo.Session,
+	msg *discordgo.MessageCreate,
+	cmd Cmd,
+	err error,
+	errHandler CmdErrorHandler,
+) {
+	if err == nil {
+		return
+	}
+	handler := errHandler
+	if cmd != nil {
+		if cmdHandler := cmd.ErrorHandler(); cmdHandler != nil {
+			handler = cmdHandler
+		}
+	}
+	if handler != nil {
+		handler(s, msg, RequestError{id, err})
+	}
+}
+
+//
+// Same as Handle, but instead of routing errors through an error handler it reports
+// back what happened. handled is true if the message resolved to a command, in which
+// case name is the command's canonical name and err is whatever the invocation
+// returned (AccessDenied if the command's predicate denied it). err may also be set
+// with handled being false if the message couldn't be tokenized, or to NoSuchCommand
+// if there's no such command and ReportUnknown is set, or to the error of
+// GlobalPredicate if it isn't satisfied.
+// Mostly useful for tests and introspection.
+//
+func (reg *CmdRegistry) Dispatch(
+	s *discordgo.Session,
+	msg *discordgo.MessageCreate,
+	pfx string,
+) (handled bool, name string, err error) {
+	cmd, name, err := reg.dispatch(newRequestID(), s, msg, []string{pfx})
+	return cmd != nil, name, err
+}
+
+//
+// Invokes the command name (which may be an alias) with args as its arguments, as
+// if m had invoked it, for macros, scheduled jobs and the like. Predicates, the
+// register's GlobalPredicate included, are still checked against m, and replies are
+// sent as usual. Errors aren't routed
+// through error handlers, but returned; NoSuchCommand if there's no such command.
+//
+func (reg *CmdRegistry) Exec(s *discordgo.Session, m *discordgo.MessageCreate, name string, args ...string) error {
+	if err := reg.GlobalPredicate.check(reg.permissions(), s, m); err != nil {
+		return err
+	}
+	cmd, name := reg.resolve(name)
+	if cmd == nil {
+		return NoSuchCommand{name}
+	}
+	return reg.invoke(newRequestID(), name, cmd, s, m, args)
+}
+
+//
+// Resolves and invokes the command in msg, if any, as request id. cmd is nil if the
+// message couldn't be resolved to a command
+//
+func (reg *CmdRegistry) dispatch(
+	id RequestID,
+	s *discordgo.Session,
+	msg *discordgo.MessageCreate,
+	prefixes []string,
+) (cmd Cmd, name string, err error) {
+	args, err := reg.parse(id, s, msg, prefixes)
+	if err != nil || len(args) == 0 {
+		return
+	}
+	if err = reg.GlobalPredicate.check(reg.permissions(), s, msg); err != nil {
+		reg.logf(id, "info", "message %s by %s denied by global predicate: %v", msg.ID, msg.Author.ID, err)
+		return
+	}
+	var canon string
+	if cmd, canon = reg.resolve(args[0]); cmd != nil {
+		name = canon
+		reg.logf(id, "debug", "message %s by %s resolved to %s", msg.ID, msg.Author.ID, name)
+		inv := reg.invocation(id, name)
+		err = reg.invokeAs(inv, cmd, s, msg, args[1:])
+		cmd = inv.resolved(cmd)
+	} else {
+		reg.logf(id, "debug", "message %s by %s names no command %q", msg.ID, msg.Author.ID, args[0])
+		if reg.ReportUnknown {
+			err = NoSuchCommand{args[0]}
+		}
+	}
+	return
+}
+
+//
+// Logs through Logf, if set, prefixing the line with request ID id
+//
+func (reg *CmdRegistry) logf(id RequestID, level, format string, args ...interface{}) {
+	if reg.Logf != nil {
+		reg.Logf(level, "[%s] "+format, append([]interface{}{id}, args...)...)
+	}
+}
+
+//
+// Logs the outcome of request id, invoking the command registered as name by the
+// author of msg
+//
+func (reg *CmdRegistry) logOutcome(id RequestID, name string, msg *discordgo.MessageCreate, err error) {
+	if reg.Logf == nil || err == nil {
+		return
+	}
+	switch err.(type) {
+	case AccessDenied, WrongContext, OnCooldown, AlreadyRunning:
+		reg.logf(id, "info", "%s by %s denied: %v", name, msg.Author.ID, err)
+		return
+	case ArgCountMismatch, ArgTooLong:
+		reg.logf(id, "info", "%s by %s failed to parse arguments: %v", name, msg.Author.ID, err)
+		return
+	}
+	if errors.As(err, &UnmarshalError{}) {
+		reg.logf(id, "info", "%s by %s failed to parse arguments: %v", name, msg.Author.ID, err)
+		return
+	}
+	reg.logf(id, "error", "%s by %s failed: %v", name, msg.Author.ID, err)
+}
+
+//
+// Tokenizes msg, returning the command name followed by its arguments, or nothing if
+// msg isn't meant for us, that is, if it doesn't start with any of prefixes. id is
+// the request ID the message is logged with
+//
+func (reg *CmdRegistry) parse(
+	id RequestID,
+	s *discordgo.Session,
+	msg *discordgo.MessageCreate,
+	prefixes []string,
+) ([]string, error) {
+	if msg.Author.ID == s.State.User.ID {
+		return nil, nil
+	}
+	pfx, ok := matchPrefix(msg.Content, prefixes)
+	if mention := mentionPrefix(msg.Content, s.State.User.ID); reg.MentionPrefix && len(mention) > len(pfx) {
+		pfx, ok = mention, true
+	}
+	if !ok {
+		return nil, nil
+	}
+	reg.logf(id, "debug", "message %s by %s matched prefix %q", msg.ID, msg.Author.ID, pfx)
+	if max := reg.MaxContentLength; max > 0 && len(msg.Content) > max {
+		return nil, ContentTooLong{max, len(msg.Content)}
+	}
+	tokenize := reg.Tokenizer
+	if tokenize == nil {
+		tokenize = splitArgs
+	}
+	/*
+	 * Prefix matching is done on bytes, which is fine as long as pfx is valid
+	 * UTF-8; we can't split a rune in half that way. What we can get is an
+	 * emoji prefix followed by a variation selector (i.e. ⭐ typed as ⭐️),
+	 * which would otherwise end up glued to the command name
+	 */
+	return tokenize(strings.TrimLeft(strings.TrimPrefix(msg.Content, pfx), variationSelectors))
+}
+
+//
+// Invokes cmd, registered as name, as request id, routing its reply if it has one
+//
+func (reg *CmdRegistry) invoke(
+	id RequestID,
+	name string,
+	cmd Cmd,
+	s *discordgo.Session,
+	msg *discordgo.MessageCreate,
+	args []string,
+) error {
+	return reg.invokeAs(reg.invocation(id, name), cmd, s, msg, args)
+}
+
+//
+// Same as invoke, but as the invocation inv, which may capture the reply instead.
+// Invocations count towards Popularity once their predicates and arguments check
+// out, whether or not the command itself then succeeds
+//
+func (reg *CmdRegistry) invokeAs(
+	inv *invocation,
+	cmd Cmd,
+	s *discordgo.Session,
+	msg *discordgo.MessageCreate,
+	args []string,
+) error {
+	id, name := inv.id, inv.name
+	reg.waitForState(s, msg.GuildID)
+	reg.warmGuild(s, msg.GuildID)
+	reg.lock.RLock()
+	middleware := reg.middleware
+	reg.lock.RUnlock()
+	var next Cmd = routedCmd{cmd, inv}
+	for c := len(middleware) - 1; c >= 0; c-- {
+		next = middleware[c](next)
+	}
+	var start time.Time
+	if reg.Observer != nil {
+		start = time.Now()
+	}
+	err := next.Invoke(s, msg, args)
+	if inv.converted {
+		reg.count(name)
+	}
+	if reg.Observer != nil {
+		reg.Observer.OnInvoke(id, name, time.Since(start), err)
+	}
+	reg.logOutcome(id, name, msg, err)
+	return err
+}
+
+//
+// Waits for up to StateWait for guild with ID guildID to be in state
+//
+func (reg *CmdRegistry) waitForState(s *discordgo.Session, guildID string) {
+	if reg.StateWait <= 0 || guildID == "" || s.State == nil {
+		return
+	}
+	deadline := time.Now().Add(reg.StateWait)
+	for {
+		if _, err := s.State.Guild(guildID); err == nil || !time.Now().Before(deadline) {
+			return
+		}
+		time.Sleep(statePollInterval)
+	}
+}
+
+//
+// Warms guild with ID guildID if WarmGuilds is set and it wasn't already. Failing
+// to do so isn't fatal, the command just falls back to fetching what it needs
+//
+func (reg *CmdRegistry) warmGuild(s *discordgo.Session, guildID string) {
+	if !reg.WarmGuilds || guildID == "" || s.State == nil {
+		return
+	}
+	if _, warmed := reg.warmed.LoadOrStore(guildID, struct{}{}); warmed {
+		return
+	}
+	if WarmGuild(s, guildID) != nil {
+		reg.warmed.Delete(guildID)
+	}
+}
+
+func (reg *CmdRegistry) invocation(id RequestID, name string) *invocation {
+	return &invocation{reg: reg, name: name, id: id, handler: new(CmdErrorHandler)}
+}
+
+//
+// Command a message was routed to, with the error handler of the subcommand it was
+// resolved to, if any (see CmdRegistry.Invoke), for routeError
+//
+type resolvedCmd struct {
+	Cmd
+	handler CmdErrorHandler
+}
+
+func (cmd resolvedCmd) ErrorHandler() CmdErrorHandler {
+	return cmd.handler
+}
+
+//
+// Returns cmd, invoked as inv, with the error handler of the subcommand it resolved
+// to, if there's one
+//
+func (inv *invocation) resolved(cmd Cmd) Cmd {
+	if inv.handler == nil || *inv.handler == nil {
+		return cmd
+	}
+	return resolvedCmd{cmd, *inv.handler}
+}
+
+func newRequestID() RequestID {
+	var id [8]byte
+	rand.Read(id[:])
+	return RequestID(hex.EncodeToString(id[:]))
+}
+
+//
+// Sends reply to the channel msg was sent in, through a webhook if there's one
+// configured for it
+//
+func (reg *CmdRegistry) reply(s *discordgo.Session, msg *discordgo.MessageCreate, reply *discordgo.MessageSend) (err error) {
+	if reg.SuppressMentions && reply.AllowedMentions == nil {
+		/* Copy, so we don't change a reply the command may hold on to */
+		suppressed := *reply
+		suppressed.AllowedMentions = &discordgo.MessageAllowedMentions{Parse: []discordgo.AllowedMentionType{}}
+		reply = &suppressed
+	}
+	if reg.FileThreshold > 0 && utf8.RuneCountInString(reply.Content) > reg.FileThreshold &&
+		reply.File == nil && len(reply.Files) == 0 {
+		attached := *reply
+		attached.Content = ""
+		attached.Files = []*discordgo.File{textFile(replyFileName, reply.Content)}
+		reply = &attached
+	}
+	/* Webhooks would drop the attachment */
+	if hook, ok := reg.Webhooks[msg.ChannelID]; ok && len(reply.Files) == 0 && reply.File == nil {
+		params := webhookParams(reply)
+		params.Username = hook.Username
+		params.AvatarURL = hook.AvatarURL
+		_, err = s.WebhookExecute(hook.ID, hook.Token, true, params)
+	} else {
+		_, err = s.ChannelMessageSendComplex(msg.ChannelID, reply)
+	}
+	return
+}
+
+//
+// Parses str into an integer of type ttype, accepting 0x, 0o and 0b prefixes
+//
+func parseInteger(ttype reflect.Type, str string) (reflect.Value, error) {
+	base := 0
+	/* Base 0 takes a leading 0 to mean octal, but people mean 007 as 7 */
+	if digits := strings.TrimLeft(str, "+-"); len(digits) > 1 && digits[0] == '0' && isDigit(digits[1]) {
+		base = 10
+	}
+	val := reflect.New(ttype).Elem()
+	bits := ttype.Bits()
+	switch ttype.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(str, base, bits)
+		if err != nil {
+			return reflect.Value{}, integerError(err, -1<<(bits-1), 1<<(bits-1)-1)
+		}
+		val.SetInt(n)
+	default:
+		n, err := strconv.ParseUint(str, base, bits)
+		if err != nil && strings.HasPrefix(str, "-") && isUnsigned(str[1:], base) {
+			/* A well-formed negative number is just out of range, not malformed */
+			err = &strconv.NumError{Func: "ParseUint", Num: str, Err: strconv.ErrRange}
+		}
+		if err != nil {
+			return reflect.Value{}, integerError(err, 0, ^uint64(0)>>(64-bits))
+		}
+		val.SetUint(n)
+	}
+	return val, nil
+}
+
+//
+// Reports a failure to parse an integer, naming the range of the parameter's type,
+// from min to max, if the number is out of it
+//
+func integerError(err error, min int64, max uint64) error {
+	if nerr, ok := err.(*strconv.NumError); ok && nerr.Err == strconv.ErrRange {
+		err = fmt.Errorf("%s is out of range, expected a number from %d to %d: %w", nerr.Num, min, max, err)
+	}
+	return UnmarshalError{Why: err}
+}
+
+/* Ways of saying yes and no accepted for bool arguments, in lower case */
+var boolWords = map[string]bool{
+	"true": true, "yes": true, "on": true, "1": true, "enable": true,
+	"false": false, "no": false, "off": false, "0": false, "disable": false,
+}
+
+//
+// Parses str into a bool of type ttype, accepting true/false, yes/no, on/off, 1/0
+// and enable/disable regardless of case
+//
+func parseBool(ttype reflect.Type, str string) (reflect.Value, error) {
+	b, ok := boolWords[strings.ToLower(str)]
+	if !ok {
+		return reflect.Value{}, UnmarshalError{Why: fmt.Errorf("parseBool: %q is neither yes nor no", str)}
+	}
+	val := reflect.New(ttype).Elem()
+	val.SetBool(b)
+	return val, nil
+}
+
+/* Whether str is a well-formed unsigned integer, no matter how large */
+func isUnsigned(str string, base int) bool {
+	_, err := strconv.ParseUint(str, base, 64)
+	return err == nil || err.(*strconv.NumError).Err == strconv.ErrRange
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+//
+// Default tokenizer, see Tokenize
+//
+func splitArgs(content string) ([]string, error) {
+	return Tokenize(content), nil
+}
+
+//
+// Returns args[from:to] as typed in content, quotes, escapes and whitespace
+// included, provided args are the last arguments of content as split by Tokenize.
+// Otherwise, as when args come from a custom tokenizer, an alias or a pipeline stage
+// other than the last, they're joined with spaces instead
+//
+func rawArgs(content string, args []string, from, to int) string {
+	tokens, spans := tokenize(content)
+	skip := len(tokens) - len(args)
+	if from >= to || skip < 0 || !reflect.DeepEqual(tokens[skip:], args) {
+		return strings.Join(args[from:to], " ")
+	}
+	return content[spans[skip+from][0]:spans[skip+to-1][1]]
+}
+
+//
+// Returns the mention of the user with ID userID content starts with, along with
+// the whitespace following it, or an empty string if it doesn't start with one
+//
+func mentionPrefix(content, userID string) string {
+	for _, mention := range []string{"<@" + userID + ">", "<@!" + userID + ">"} {
+		if strings.HasPrefix(content, mention) {
+			rest := strings.TrimLeftFunc(content[len(mention):], unicode.IsSpace)
+			return content[:len(content)-len(rest)]
+		}
+	}
+	return ""
+}
+
+//
+// Returns the longest of prefixes content starts with
+//
+func matchPrefix(content string, prefixes []string) (pfx string, ok bool) {
+	for _, candidate := range prefixes {
+		if strings.HasPrefix(content, candidate) && (!ok || len(candidate) > len(pfx)) {
+			pfx, ok = candidate, true
+		}
+	}
+	return
+}
+
+//
+// Returns a handler function, suitable to be used with discordgo.Session.AddHandler
+// pfx represents a prefix string for prefixed commands
+// errHandler is an optional error handler. If non-nil, it will be called when a command
+// returns an error when executing. It can be overriden on a per-command basis
+//
+func (reg *CmdRegistry) Handler(
+	pfx string,
+	errHandler CmdErrorHandler,
+) func(*discordgo.Session, *discordgo.MessageCreate) {
+	return reg.MultiPrefixHandler([]string{pfx}, errHandler)
+}
+
+//
+// Same as Handler, but each command runs in a goroutine of its own, so that slow
+// commands don't hold up discordgo's other handlers. Commands panicking (including
+// ones that don't recover on their own, unlike those created with Command) have the
+// panic reported to the error handler as an error instead of crashing the bot
+//
+func (reg *CmdRegistry) AsyncHandler(
+	pfx string,
+	errHandler CmdErrorHandler,
+) func(*discordgo.Session, *discordgo.MessageCreate) {
+	return func(s *discordgo.Session, msg *discordgo.MessageCreate) {
+		go func() {
+			id := newRequestID()
+			cmd, err := reg.dispatchRecover(id, s, msg, []string{pfx})
+			routeError(id, s, msg, cmd, err, errHandler)
+		}()
+	}
+}
+
+//
+// Same as dispatch, but a panic is returned as an error
+//
+func (reg *CmdRegistry) dispatchRecover(
+	id RequestID,
+	s *discordgo.Session,
+	msg *discordgo.MessageCreate,
+	prefixes []string,
+) (cmd Cmd, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("Cmd.Invoke: %v", e)
+		}
+	}()
+	cmd, _, err = reg.dispatch(id, s, msg, prefixes)
+	return
+}
+
+//
+// Same as Handler, but the prefix is looked up for each message with pf, for bots
+// letting each guild configure its own prefix. Messages for which pf returns an
+// empty string are ignored, unless they start with a mention of the bot and
+// MentionPrefix is set.
+//
+func (reg *CmdRegistry) HandlerFunc(
+	pf CmdPrefixFunc,
+	errHandler CmdErrorHandler,
+) func(*discordgo.Session, *discordgo.MessageCreate) {
+	return func(s *discordgo.Session, msg *discordgo.MessageCreate) {
+		var prefixes []string
+		if pfx := pf(s, msg); pfx != "" {
+			prefixes = []string{pfx}
+		}
+		reg.HandleMulti(s, msg, prefixes, errHandler)
+	}
+}
+
+//
+// Same as Handler, but commands may be prefixed by any of prefixes, see HandleMulti
+//
+func (reg *CmdRegistry) MultiPrefixHandler(
+	prefixes []string,
+	errHandler CmdErrorHandler,
+) func(*discordgo.Session, *discordgo.MessageCreate) {
+	return func(s *discordgo.Session, msg *discordgo.MessageCreate) {
+		reg.HandleMulti(s, msg, prefixes, errHandler)
+	}
+}
+
+func (reg *CmdRegistry) count(name string) {
+	counter, ok := reg.stats.Load(name)
+	if !ok {
+		counter, _ = reg.stats.LoadOrStore(name, new(uint64))
+	}
+	atomic.AddUint64(counter.(*uint64), 1)
+}
+
+//
+// Adds middleware wrapping every command invoked through the register, including
+// ones added later, for concerns such as logging or metrics. Middleware added first
+// runs outermost. The command passed to middleware runs the actual command with
+// the register's configuration, predicates included, and sends its reply; its
+// error handler is still the one errors are routed to.
+// Commands whose reply is piped into another (see HandlePipeline) aren't wrapped.
+//
+func (reg *CmdRegistry) Use(middleware ...CmdMiddleware) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	reg.middleware = append(append([]CmdMiddleware{}, reg.middleware...), middleware...)
+}
+
+//
+// Sets a function to be called whenever a command is about to be invoked through the
+// register, after its arguments were successfully converted. It receives the request
+// ID (see RequestID), the name of the command and the converted arguments, i.e. the *discordgo.User a mention
+// resolved to, which is more meaningful to audit logs than the raw message.
+// Only commands created with Command are audited.
+//
+func (reg *CmdRegistry) SetAuditHook(hook CmdAuditHook) {
+	reg.auditHook = hook
+}
+
+//
+// Sets a function to be used instead of MemberHasPermissions when checking the
+// Permissions of predicates of commands invoked through the register, so that bots
+// with their own permission model can still declare requirements on predicates.
+// It's also asked for PermissionAdministrator if AdministratorOverrides is set.
+// Unlike the default, which grants the guild's owner everything, resolve alone
+// decides whether the owner may run a command. Errors it returns are reported as
+// the command's error. Passing nil restores the default.
+//
+func (reg *CmdRegistry) SetPermissionResolver(resolve CmdPermissionResolver) {
+	reg.permResolver = resolve
+}
+
+//
+// Returns the function used to check permissions of commands invoked through
+// the register, see SetPermissionResolver
+//
+func (reg *CmdRegistry) permissions() CmdPermissionResolver {
+	if reg == nil || reg.permResolver == nil {
+		return memberPermissions
+	}
+	return reg.permResolver
+}
+
+//
+// Returns how many times each command was invoked through Handle, most used
+// commands first. Invocations denied by predicates or middleware, or with
+// arguments that couldn't be converted, aren't counted
+//
+func (reg *CmdRegistry) Popularity() []CmdStat {
+	var stats []CmdStat
+	reg.stats.Range(func(name, counter interface{}) bool {
+		stats = append(stats, CmdStat{name.(string), atomic.LoadUint64(counter.(*uint64))})
+		return true
+	})
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Count == stats[j].Count {
+			return stats[i].Name < stats[j].Name
+		}
+		return stats[i].Count > stats[j].Count
+	})
+	return stats
+}
+
+//
+// Resets invocation counters reported by Popularity
+//
+func (reg *CmdRegistry) ResetStats() {
+	reg.stats.Range(func(name, _ interface{}) bool {
+		reg.stats.Delete(name)
+		return true
+	})
+}
+
+//
+// Returns the sorted names of the commands in the register whose predicates the
+// author of m satisfies, for help commands that only list what the user can run.
+// Cooldowns are ignored, and permissions are only resolved once for each distinct
+// set of required permissions. Commands wrapped by WithPredicate and the like must
+// satisfy the predicates of every wrapper as well as their own. Commands without a
+// PredicateInfo method are assumed to be available to everyone.
+//
+func (reg *CmdRegistry) AvailableTo(s *discordgo.Session, m *discordgo.MessageCreate) []string {
+	resolve := reg.permissions()
+	resolved := map[int]bool{}
+	cached := func(s *discordgo.Session, m *discordgo.MessageCreate, required int) (bool, error) {
+		perm, ok := resolved[required]
+		if !ok {
+			var err error
+			if perm, err = resolve(s, m, required); err != nil {
+				return false, err
+			}
+			resolved[required] = perm
+		}
+		return perm, nil
+	}
+
+	cmds, _ := reg.effective()
+
+	var names []string
+	for name, cmd := range cmds {
+		available := true
+		for _, pred := range cmdPredicates(cmd) {
+			pred.Cooldown = nil
+			if available = pred.check(cached, s, m) == nil; !available {
+				break
+			}
+		}
+		if available {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+//
+// Tells whether the author of m may run the command name, and why (i.e. a missing
+// permission, the wrong kind of channel or a cooldown), for commands that help users
+// figure out why they can't run something. Cooldowns are checked without counting
+// as an invocation. Predicates of wrappers (see WithPredicate) are explained along
+// with the wrapped command's, the first one denying the invocation giving the reason.
+//
+func (reg *CmdRegistry) Explain(s *discordgo.Session, m *discordgo.MessageCreate, name string) (allowed bool, reason string) {
+	cmd := reg.Get(name)
+	if cmd == nil {
+		return false, "there's no command named " + name
+	}
+	preds := cmdPredicates(cmd)
+	if len(preds) == 0 {
+		return true, "it has no requirements"
+	}
+	for _, pred := range preds {
+		if allowed, reason = pred.explain(reg.permissions(), s, m); !allowed {
+			return
+		}
+	}
+	return
+}
+
+//
+// Renders every command in the register as an indented tree, sorted by name, one
+// command per line followed by its aliases in brackets, and subcommands indented
+// under their command, i.e.
+//
+//	config
+//	  get
+//	  set [put]
+//	echo [say, repeat]
+//	help
+//
+func (reg *CmdRegistry) Tree() string {
+	var b strings.Builder
+	reg.writeTree(&b, "")
+	return b.String()
+}
+
+func (reg *CmdRegistry) writeTree(b *strings.Builder, indent string) {
+	cmds, dests := reg.effective()
+	aliases := map[string][]string{}
+	for alias, dest := range dests {
+		aliases[dest] = append(aliases[dest], alias)
+	}
+	names := make([]string, 0, len(cmds))
+	for name := range cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.WriteString(indent + name)
+		if len(aliases[name]) > 0 {
+			sort.Strings(aliases[name])
+			fmt.Fprintf(b, " [%s]", strings.Join(aliases[name], ", "))
+		}
+		b.WriteByte('\n')
+		if sub, ok := cmds[name].(*CmdRegistry); ok {
+			sub.writeTree(b, indent+"  ")
+		}
+	}
+}
+
+//
+// Creates an empty command register
+//
+func Registry() *CmdRegistry {
+	return &CmdRegistry{
+		Cmds:    map[string]Cmd{},
+		Aliases: map[string]string{},
+	}
+}
+
+//
+// Whether args is a request for a command's help, see HelpTokens
+//
+func (reg *CmdRegistry) isHelpToken(args []string) bool {
+	if reg == nil || len(args) != 1 {
+		return false
+	}
+	for _, token := range reg.HelpTokens {
+		if args[0] == token {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Errors if tryConvert can't parse arguments into values of type ttype
+//
+func checkParamType(ttype reflect.Type) error {
+	if converterFor(ttype) != nil || isJSONArg(ttype) || isScannedArg(ttype) || ttype == anyType {
+		return nil
+	}
+	switch kind := ttype.Kind(); {
+	case illegalKinds[kind]:
+		return fmt.Errorf("argument of kind %s not supported", kind)
+	case kind == reflect.Ptr && !lookupTypes[ttype] && !isParsedPointer(ttype):
+		return fmt.Errorf("argument of type %s not supported", ttype)
+	}
+	return nil
+}
+
+//
+// Same as tryConvert, but gives precedence to the register's Colors and converters,
+// and applies its NotFoundMessages. reg may be nil
+//
+func (reg *CmdRegistry) convert(
+	s *discordgo.Session,
+	m *discordgo.MessageCreate,
+	ttype reflect.Type,
+	str string,
+) (reflect.Value, error) {
+	if reg == nil {
+		return tryConvert(s, m, ttype, str)
+	}
+	if ttype == colorType {
+		/* Palette names may well be valid hex, i.e. "bad", so they come first */
+		for name, color := range reg.Colors {
+			if strings.EqualFold(name, str) {
+				return reflect.ValueOf(color), nil
+			}
+		}
+	}
+	var val reflect.Value
+	var err error
+	if conv := reg.Converters[ttype]; conv != nil {
+		val, err = convertWith(conv, s, m, ttype, str)
+	} else {
+		val, err = tryConvert(s, m, ttype, str)
+	}
+	if uerr, ok := err.(UnmarshalError); ok && !uerr.Transient {
+		if msg, ok := reg.NotFoundMessages[ttype]; ok {
+			uerr.Why = UserFacing{Public: msg, Err: uerr.Why}
+			err = uerr
+		}
+	}
+	return val, err
+}
+
+//
+// Parses str with conv, making sure it returns a value of type ttype
+//
+func convertWith(
+	conv CmdConverter,
+	s *discordgo.Session,
+	m *discordgo.MessageCreate,
+	ttype reflect.Type,
+	str string,
+) (val reflect.Value, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = UnmarshalError{Why: fmt.Errorf("convertWith: %v", e)}
+			if s == nil {
+				/* Most likely why it panicked */
+				err = UnmarshalError{Why: fmt.Errorf("convertWith: session required to resolve %s (%v)", ttype, e)}
+			}
+		}
+	}()
+	ret, err := conv(s, m, str)
+	if err != nil {
+		err = UnmarshalError{Why: err, Transient: isTransient(err)}
+		return
+	}
+	if val = reflect.ValueOf(ret); !val.IsValid() || !val.Type().AssignableTo(ttype) {
+		err = UnmarshalError{Why: fmt.Errorf("convertWith: converter for %s returned %T", ttype, ret)}
+	}
+	return
+}
+
+//
+// Errors unless the message linked to, in channel chanID of guild guildID (as
+// given by ParseMessageLink), is in the guild m was sent in, or in the same direct
+// message channel, so that commands taking messages can't be used to read messages
+// the bot can see elsewhere
+//
+func checkMessageLink(s *discordgo.Session, m *discordgo.MessageCreate, guildID, chanID string) error {
+	if m == nil {
+		return UnmarshalError{Why: errors.New("tryConvert: message links need an invocation")}
+	}
+	if guildID == "@me" {
+		if m.GuildID != "" || chanID != m.ChannelID {
+			return UnmarshalError{Why: errors.New("tryConvert: message is from another conversation")}
+		}
+		return nil
+	}
+	if guildID != m.GuildID {
+		return UnmarshalError{Why: errors.New("tryConvert: message is from another server")}
+	}
+	/* The link's guild is only what it claims to be, the channel has the final say */
+	channel, err := stateChannel(s, chanID)
+	if err != nil {
+		return UnmarshalError{Why: errors.New("tryConvert: cannot fetch channel"), Transient: isTransient(err)}
+	}
+	if channel.GuildID != m.GuildID {
+		return UnmarshalError{Why: errors.New("tryConvert: message is from another server")}
+	}
+	return nil
+}
+
+//
+// Attempts to parse str into the required type ttype, errors if it can't be done
+// m is the message that triggered the conversion, used by types that need to be
+// resolved within a guild. It may be nil.
+// s may be nil as well, for checking arguments without a connection, in which
+// case types that need looking up fail to convert.
+//
+func tryConvert(
+	s *discordgo.Session,
+	m *discordgo.MessageCreate,
+	ttype reflect.Type,
+	str string,
+) (val reflect.Value, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = UnmarshalError{Why: fmt.Errorf("tryConvert: %v", e)}
+		}
+	}()
+	if _, custom := customConverters.Load(ttype); s == nil && !custom && sessionTypes[ttype] {
+		err = UnmarshalError{Why: fmt.Errorf("tryConvert: session required to resolve %s", typeName(ttype))}
+		return
+	}
+	if conv := converterFor(ttype); conv != nil {
+		return convertWith(conv, s, m, ttype, str)
+	}
+	if isScannedArg(ttype) {
+		return parseScannedArg(ttype, str)
+	}
+	switch ttype.Kind() {
+	case reflect.String:
+		val = reflect.ValueOf(str)
+	case reflect.Struct:
+		val, err = parseJSONArg(ttype, str)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		val, err = parseInteger(ttype, str)
+	case reflect.Bool:
+		val, err = parseBool(ttype, str)
+	case reflect.Ptr:
+		/*
+		 * For those, we first consider the string as a mention
+		 * failing that, we look it up as an id, and if it fails,
 		 * we give up
 		 * We could try considering it as a name and looking it up,
 		 * not sure if it's worth the effort
@@ -384,32 +2617,67 @@ func tryConvert(s *discordgo.Session, ttype reflect.Type, str string) (val refle
 		case channelType:
 			var chann *discordgo.Channel
 			var id uint64
+			var errs [2]error
 			fmt.Sscanf(str, "<#%d>", &id)
-			chann, _ = s.Channel(strconv.FormatUint(id, 10))
+			chann, errs[0] = s.Channel(strconv.FormatUint(id, 10))
 			if chann == nil {
-				chann, _ = s.Channel(str)
+				chann, errs[1] = s.Channel(str)
 			}
 			if chann == nil {
-				err = UnmarshalError{errors.New("tryConvert: cannot parse channel")}
+				err = UnmarshalError{
+					Why:       errors.New("tryConvert: cannot parse channel"),
+					Transient: isTransient(errs[0]) || isTransient(errs[1]),
+				}
 			} else {
 				val = reflect.ValueOf(chann)
 			}
 		case userType:
 			var user *discordgo.User
 			var id uint64
+			var errs [2]error
 			fmt.Sscanf(str, "<@!%d>", &id)
-			user, _ = s.User(strconv.FormatUint(id, 10))
+			user, errs[0] = s.User(strconv.FormatUint(id, 10))
 			if user == nil {
-				user, _ = s.User(str)
+				user, errs[1] = s.User(str)
 			}
 			if user == nil {
-				err = UnmarshalError{errors.New("tryConvert: cannot parse user")}
+				err = UnmarshalError{
+					Why:       errors.New("tryConvert: cannot parse user"),
+					Transient: isTransient(errs[0]) || isTransient(errs[1]),
+				}
 			} else {
 				val = reflect.ValueOf(user)
 			}
+		case messageType:
+			/* Messages are only accepted as links, there's no such thing as a message mention */
+			var guildID, chanID, msgID string
+			if guildID, chanID, msgID, err = ParseMessageLink(str); err != nil {
+				err = UnmarshalError{Why: fmt.Errorf("tryConvert: %v", err)}
+				break
+			}
+			if err = checkMessageLink(s, m, guildID, chanID); err != nil {
+				break
+			}
+			msg, _ := s.State.Message(chanID, msgID)
+			var fetchErr error
+			if msg == nil {
+				msg, fetchErr = s.ChannelMessage(chanID, msgID)
+			}
+			if msg == nil {
+				err = UnmarshalError{
+					Why:       errors.New("tryConvert: cannot fetch message"),
+					Transient: isTransient(fetchErr),
+				}
+			} else {
+				val = reflect.ValueOf(msg)
+			}
 		default:
+			if isParsedPointer(ttype) {
+				val, err = parsePointerArg(s, m, ttype, str)
+				break
+			}
 			err = UnmarshalError{
-				fmt.Errorf("tryConvert: can't unmarshal pointer to %s", underlying),
+				Why: fmt.Errorf("tryConvert: can't unmarshal pointer to %s", underlying),
 			}
 		}
 	default:
@@ -422,7 +2690,7 @@ func tryConvert(s *discordgo.Session, ttype reflect.Type, str string) (val refle
 		if err == nil {
 			val = val.Elem()
 		} else {
-			err = UnmarshalError{err}
+			err = UnmarshalError{Why: err}
 		}
 	}
 	return
@@ -1,8 +1,19 @@
 package dgutils
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
@@ -26,7 +37,7 @@ func TestTryConvert(t *testing.T) {
 		"3.1415926": valOf(float64(3.1415926)), /* double	*/
 	}
 	for str, val := range vals {
-		actual, err := tryConvert(nil, val.Type(), str)
+		actual, err := tryConvert(nil, nil, val.Type(), str)
 		if err != nil {
 			t.Errorf("errored out for value '%v' of expected type '%s'", str, val.Type())
 		}
@@ -47,3 +58,2029 @@ func TestInvoke(t *testing.T) {
 	)
 	stub.Invoke(nil, nil, []string{"3", "-2", "hello", "true", "4.5", "3.1415926", "hello", "there"})
 }
+
+func testSession() *discordgo.Session {
+	s := &discordgo.Session{State: discordgo.NewState()}
+	s.State.User = &discordgo.User{ID: "bot"}
+	return s
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+/* Session whose REST requests are recorded in reqs rather than sent to Discord */
+func testRESTSession(reqs *[]*http.Request) *discordgo.Session {
+	s, _ := discordgo.New("Bot test")
+	s.State.User = &discordgo.User{ID: "bot"}
+	s.Client = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		*reqs = append(*reqs, req)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("{}")),
+			Request:    req,
+		}, nil
+	})}
+	return s
+}
+
+/* Session whose every request fails with status */
+func testStatusSession(status int) *discordgo.Session {
+	s, _ := discordgo.New("Bot test")
+	s.State.User = &discordgo.User{ID: "bot"}
+	s.Client = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: status,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("{}")),
+			Request:    req,
+		}, nil
+	})}
+	return s
+}
+
+func testMessage(content string) *discordgo.MessageCreate {
+	return &discordgo.MessageCreate{
+		Message: &discordgo.Message{
+			Content: content,
+			Author:  &discordgo.User{ID: "user"},
+		},
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	s := testSession()
+	reg := Registry()
+	reg.Add("echo", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, str string) {}, "", nil))
+	reg.Alias("say", "echo")
+
+	cases := []struct {
+		content string
+		handled bool
+		name    string
+		err     error
+	}{
+		{"hello there", false, "", nil},
+		{"!bogus", false, "", nil},
+		{"!echo hi", true, "echo", nil},
+		{"!say hi", true, "echo", nil},
+		{"!echo", true, "echo", ArgCountMismatch{1, 0}},
+	}
+	for _, c := range cases {
+		handled, name, err := reg.Dispatch(s, testMessage(c.content), "!")
+		if handled != c.handled || name != c.name || err != c.err {
+			t.Errorf("'%s': expected (%v, '%s', %v) but got (%v, '%s', %v)",
+				c.content, c.handled, c.name, c.err, handled, name, err)
+		}
+	}
+}
+
+func TestTokenizer(t *testing.T) {
+	s := testSession()
+	reg := Registry()
+	var got []string
+	reg.Add("set", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+		got = args
+	}, "", nil))
+	reg.Tokenizer = func(content string) ([]string, error) {
+		if content == "" {
+			return nil, errors.New("empty command")
+		}
+		return strings.FieldsFunc(content, func(r rune) bool {
+			return r == ' ' || r == '='
+		}), nil
+	}
+
+	if _, _, err := reg.Dispatch(s, testMessage("!set key=value"), "!"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(got, []string{"key", "value"}) {
+		t.Errorf("expected [key value] but got %q", got)
+	}
+	if handled, _, err := reg.Dispatch(s, testMessage("!"), "!"); handled || err == nil {
+		t.Errorf("expected tokenizer error to be reported, got (%v, %v)", handled, err)
+	}
+}
+
+func TestMultiBytePrefix(t *testing.T) {
+	s := testSession()
+	reg := Registry()
+	var got int
+	reg.Add("roll", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, sides int) {
+		got = sides
+	}, "", nil))
+
+	for pfx, content := range map[string]string{
+		"🎲":  "🎲roll 6",
+		"⭐":  "⭐️roll 6", /* with a trailing variation selector */
+		"ñ!": "ñ!roll 6",
+	} {
+		got = 0
+		handled, name, err := reg.Dispatch(s, testMessage(content), pfx)
+		if !handled || name != "roll" || err != nil || got != 6 {
+			t.Errorf("'%s' with prefix '%s': got (%v, '%s', %v), sides %d",
+				content, pfx, handled, name, err, got)
+		}
+	}
+	if handled, _, _ := reg.Dispatch(s, testMessage("🎯roll 6"), "🎲"); handled {
+		t.Errorf("command dispatched with the wrong emoji prefix")
+	}
+}
+
+func TestBind(t *testing.T) {
+	var gotSides, gotTimes int
+	dice := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, sides, times int) {
+		gotSides, gotTimes = sides, times
+	}, "Rolls dice", nil)
+
+	roll, err := dice.Bind("6")
+	if err != nil {
+		t.Fatalf("unexpected error binding: %s", err)
+	}
+	if err := roll.Invoke(nil, nil, []string{"2"}); err != nil {
+		t.Fatalf("unexpected error invoking: %s", err)
+	}
+	if gotSides != 6 || gotTimes != 2 {
+		t.Errorf("expected (6, 2) but got (%d, %d)", gotSides, gotTimes)
+	}
+	if err := roll.Invoke(nil, nil, []string{"6", "2"}); err == nil {
+		t.Errorf("bound command accepted a bound argument")
+	}
+	if _, err := dice.Bind("six"); err == nil {
+		t.Errorf("binding an invalid argument succeeded")
+	}
+	if _, err := dice.Bind("6", "2", "1"); err == nil {
+		t.Errorf("binding too many arguments succeeded")
+	}
+}
+
+func TestAggregateErrors(t *testing.T) {
+	sum := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, nums []int) {}, "", nil)
+	args := []string{"1", "two", "3", "four"}
+
+	err := sum.Invoke(nil, nil, args)
+	var uerr UnmarshalError
+	if !errors.As(err, &uerr) {
+		t.Fatalf("expected UnmarshalError but got %v", err)
+	} else if _, joined := uerr.Why.(joinedError); joined {
+		t.Errorf("errors aggregated without AggregateErrors set")
+	}
+
+	sum.AggregateErrors = true
+	err = sum.Invoke(nil, nil, args)
+	if uerr, ok := err.(UnmarshalError); !ok {
+		t.Fatalf("expected UnmarshalError but got %v", err)
+	} else if errs, ok := uerr.Why.(joinedError); !ok || len(errs) != 2 {
+		t.Errorf("expected 2 aggregated errors but got %v", uerr.Why)
+	}
+	if err := sum.Invoke(nil, nil, []string{"1", "2"}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestMaxContentLength(t *testing.T) {
+	s := testSession()
+	reg := Registry()
+	reg.Add("echo", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, str []string) {}, "", nil))
+	reg.MaxContentLength = 16
+
+	if _, _, err := reg.Dispatch(s, testMessage("!echo short"), "!"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	long := "!echo " + strings.Repeat("\"a\" ", 64)
+	if handled, _, err := reg.Dispatch(s, testMessage(long), "!"); handled || err != (ContentTooLong{16, len(long)}) {
+		t.Errorf("expected ContentTooLong but got (%v, %v)", handled, err)
+	}
+	if _, _, err := reg.Dispatch(s, testMessage(strings.Repeat("chatter ", 64)), "!"); err != nil {
+		t.Errorf("unprefixed message got rejected: %s", err)
+	}
+}
+
+func TestReplies(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	reg := Registry()
+	reg.Add("ping", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) string {
+		return "pong"
+	}, "", nil))
+	reg.Add("quiet", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) string {
+		return ""
+	}, "", nil))
+	reg.Webhooks = map[string]CmdWebhook{"hooked": {ID: "1", Token: "token", Username: "Pinger"}}
+
+	expect := map[string]string{
+		"plain":  "/channels/plain/messages",
+		"hooked": "/webhooks/1/token",
+	}
+	for channel, path := range expect {
+		reqs = nil
+		m := testMessage("!ping")
+		m.ChannelID = channel
+		if _, _, err := reg.Dispatch(s, m, "!"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(reqs) != 1 || !strings.HasSuffix(reqs[0].URL.Path, path) {
+			t.Errorf("expected reply in %s to be sent to %s, got %v", channel, path, reqs)
+		}
+	}
+
+	reqs = nil
+	reg.Dispatch(s, testMessage("!quiet"), "!")
+	if len(reqs) != 0 {
+		t.Errorf("empty reply was sent")
+	}
+
+	if _, err := Command(func(s *discordgo.Session, m *discordgo.MessageCreate) int { return 0 }, "", nil); err == nil {
+		t.Errorf("function returning int was accepted")
+	}
+}
+
+func TestThreadPredicates(t *testing.T) {
+	s := testSession()
+	s.State.GuildAdd(&discordgo.Guild{
+		ID: "guild",
+		Channels: []*discordgo.Channel{
+			{ID: "text", GuildID: "guild", Type: discordgo.ChannelTypeGuildText},
+			{ID: "forum", GuildID: "guild", Type: channelTypeGuildForum},
+			{ID: "thread", GuildID: "guild", Type: channelTypeGuildPublicThread, ParentID: "text"},
+			{ID: "post", GuildID: "guild", Type: channelTypeGuildPublicThread, ParentID: "forum"},
+		},
+	})
+
+	preds := map[string]CmdPredicate{
+		"threads":    {ThreadOnly: true},
+		"no threads": {NoThreads: true},
+		"forums":     {ForumOnly: true},
+	}
+	allowed := map[string]map[string]bool{
+		"threads":    {"text": false, "thread": true, "post": true},
+		"no threads": {"text": true, "thread": false, "post": false},
+		"forums":     {"text": false, "thread": false, "post": true},
+	}
+	for name, pred := range preds {
+		for channel, allow := range allowed[name] {
+			m := testMessage("")
+			m.GuildID, m.ChannelID = "guild", channel
+			err := pred.Check(s, m)
+			if _, wrong := err.(WrongContext); allow && err != nil || !allow && !wrong {
+				t.Errorf("%s predicate in %s channel: got %v", name, channel, err)
+			}
+		}
+	}
+}
+
+func TestTree(t *testing.T) {
+	reg := Registry()
+	fn := func(s *discordgo.Session, m *discordgo.MessageCreate) {}
+	reg.Add("help", MustCommand(fn, "", nil))
+	reg.Add("echo", MustCommand(fn, "", nil))
+	reg.Alias("say", "echo")
+	reg.Alias("repeat", "echo")
+
+	expect := "echo [repeat, say]\nhelp\n"
+	if tree := reg.Tree(); tree != expect {
+		t.Errorf("expected tree\n%s\nbut got\n%s", expect, tree)
+	}
+}
+
+func TestRegistryConverters(t *testing.T) {
+	s := testSession()
+	var got int
+	cmd := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, n int) {
+		got = n
+	}, "", nil)
+
+	plain, words := Registry(), Registry()
+	plain.Add("count", cmd)
+	words.Add("count", cmd)
+	words.Converters = map[reflect.Type]CmdConverter{
+		reflect.TypeOf(0): func(s *discordgo.Session, m *discordgo.MessageCreate, str string) (interface{}, error) {
+			for n, word := range []string{"zero", "one", "two", "three"} {
+				if str == word {
+					return n, nil
+				}
+			}
+			return nil, errors.New("not a number I know")
+		},
+	}
+
+	if _, _, err := words.Dispatch(s, testMessage("!count two"), "!"); err != nil || got != 2 {
+		t.Errorf("expected 2 but got %d (%v)", got, err)
+	}
+	if _, _, err := words.Dispatch(s, testMessage("!count 2"), "!"); err == nil {
+		t.Errorf("register converter didn't take precedence over built-in conversion")
+	}
+	if _, _, err := plain.Dispatch(s, testMessage("!count 3"), "!"); err != nil || got != 3 {
+		t.Errorf("expected 3 but got %d (%v)", got, err)
+	}
+	if _, _, err := plain.Dispatch(s, testMessage("!count two"), "!"); err == nil {
+		t.Errorf("converter leaked into another register")
+	}
+}
+
+func TestPopularity(t *testing.T) {
+	s := testSession()
+	reg := Registry()
+	fn := func(s *discordgo.Session, m *discordgo.MessageCreate) {}
+	reg.Add("ping", MustCommand(fn, "", nil))
+	reg.Add("help", MustCommand(fn, "", nil))
+	reg.Alias("p", "ping")
+	reg.Add("roll", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, n int) {}, "", nil))
+	reg.Add("never", MustPredicatedCommand(fn, "", nil, CmdPredicate{
+		Custom: func(s *discordgo.Session, m *discordgo.MessageCreate, p CmdPredicate) bool {
+			return false
+		},
+	}))
+	config := Registry()
+	config.Add("get", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, n int) {}, "", nil))
+	reg.Add("config", config)
+
+	for _, content := range []string{
+		"!ping", "!p", "!help", "!ping", "!bogus", "chatter",
+		"!roll 2", "!roll two", "!never", "!config get 1", "!config get one", "!config bogus",
+	} {
+		reg.Dispatch(s, testMessage(content), "!")
+	}
+	expect := []CmdStat{{"ping", 3}, {"config", 1}, {"help", 1}, {"roll", 1}}
+	if stats := reg.Popularity(); !reflect.DeepEqual(stats, expect) {
+		t.Errorf("expected %v but got %v", expect, stats)
+	}
+	if stats, expect := config.Popularity(), []CmdStat{{"get", 1}}; !reflect.DeepEqual(stats, expect) {
+		t.Errorf("expected subcommand stats %v but got %v", expect, stats)
+	}
+	reg.ResetStats()
+	if stats := reg.Popularity(); len(stats) != 0 {
+		t.Errorf("expected no stats after reset, got %v", stats)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	s := testSession()
+	reg := Registry()
+	var ids []RequestID
+	reg.Add("trace", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, id RequestID, n int) {
+		ids = append(ids, id)
+	}, "", nil))
+
+	for c := 0; c < 2; c++ {
+		if _, _, err := reg.Dispatch(s, testMessage("!trace 1"), "!"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if len(ids) != 2 || ids[0] == "" || ids[0] == ids[1] {
+		t.Errorf("expected two distinct request IDs, got %q", ids)
+	}
+}
+
+func TestCommandParamValidation(t *testing.T) {
+	type thing struct{}
+	valid := []interface{}{
+		func(s *discordgo.Session, m *discordgo.MessageCreate, u *discordgo.User, r RoleID) {},
+		func(s *discordgo.Session, m *discordgo.MessageCreate, users []*discordgo.User) {},
+	}
+	invalid := []interface{}{
+		func(s *discordgo.Session, m *discordgo.MessageCreate, t *thing) {},
+		func(s *discordgo.Session, m *discordgo.MessageCreate, t []*thing) {},
+		func(s *discordgo.Session, m *discordgo.MessageCreate, t []map[string]int) {},
+		func(s *discordgo.Session, m *discordgo.MessageCreate, t **discordgo.User) {},
+	}
+	for _, fn := range valid {
+		if _, err := Command(fn, "", nil); err != nil {
+			t.Errorf("%T: unexpected error: %s", fn, err)
+		}
+	}
+	for _, fn := range invalid {
+		if _, err := Command(fn, "", nil); err == nil {
+			t.Errorf("%T: expected an error", fn)
+		}
+	}
+}
+
+func TestLongRunning(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	reg := Registry()
+	cmd := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+		panic("oops")
+	}, "", nil)
+	cmd.LongRunning = true
+	reg.Add("slow", cmd)
+
+	m := testMessage("!slow")
+	m.GuildID, m.ChannelID = "guild", "channel"
+	if _, _, err := reg.Dispatch(s, m, "!"); err == nil {
+		t.Errorf("panic wasn't reported")
+	}
+	if len(reqs) != 1 || !strings.HasSuffix(reqs[0].URL.Path, "/channels/channel/typing") {
+		t.Errorf("expected typing indicator to be sent, got %v", reqs)
+	}
+
+	reqs = nil
+	m.GuildID = ""
+	reg.Dispatch(s, m, "!")
+	if len(reqs) != 0 {
+		t.Errorf("typing indicator sent in direct messages")
+	}
+}
+
+func TestAuditHook(t *testing.T) {
+	s := testSession()
+	reg := Registry()
+	var kickID RequestID
+	reg.Add("kick", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, id RequestID, n int, reason []string) {
+		kickID = id
+	}, "", nil))
+	reg.Alias("k", "kick")
+
+	var names []string
+	var ids []RequestID
+	var resolved [][]interface{}
+	reg.SetAuditHook(func(s *discordgo.Session, m *discordgo.MessageCreate, id RequestID, name string, args []interface{}) {
+		names = append(names, name)
+		ids = append(ids, id)
+		resolved = append(resolved, args)
+	})
+
+	reg.Dispatch(s, testMessage("!k 3 spamming links"), "!")
+	reg.Dispatch(s, testMessage("!kick three"), "!")
+	if !reflect.DeepEqual(names, []string{"kick"}) {
+		t.Fatalf("expected a single audit of kick, got %v", names)
+	}
+	if expect := []interface{}{3, []string{"spamming", "links"}}; !reflect.DeepEqual(resolved[0], expect) {
+		t.Errorf("expected resolved arguments %v but got %v", expect, resolved[0])
+	}
+	if ids[0] == "" || ids[0] != kickID {
+		t.Errorf("expected the audit to carry request ID %q, got %q", kickID, ids[0])
+	}
+}
+
+func TestHelpTokens(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	ran := false
+	roll := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, sides int, who []*discordgo.User) {
+		ran = true
+	}, "Rolls dice", nil)
+	roll.Predicate.Cooldown = Cooldown(time.Hour)
+	reg := Registry()
+	reg.HelpTokens = []string{"?", "--help"}
+	reg.Add("roll", roll)
+	reg.Add("secret", MustPredicatedCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+	}, "", nil, CmdPredicate{
+		Custom: func(s *discordgo.Session, m *discordgo.MessageCreate, p CmdPredicate) bool {
+			return false
+		},
+	}))
+
+	for _, token := range reg.HelpTokens {
+		reqs = nil
+		if _, _, err := reg.Dispatch(s, testMessage("!roll "+token), "!"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if ran || len(reqs) != 1 {
+			t.Errorf("expected %q to reply with help instead of running the command", token)
+		}
+	}
+	if expect := "`roll <number> <user...>`\nRolls dice"; roll.usage("roll") != expect {
+		t.Errorf("expected usage %q but got %q", expect, roll.usage("roll"))
+	}
+	if _, _, err := reg.Dispatch(s, testMessage("!secret ?"), "!"); err != (AccessDenied{}) {
+		t.Errorf("expected help for denied command to fail with AccessDenied, got %v", err)
+	}
+}
+
+func TestKeyword(t *testing.T) {
+	s := testSession()
+	var gotAll, gotVerbose bool
+	var gotFilter string
+	list := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, all, verbose bool, filter string) {
+		gotAll, gotVerbose, gotFilter = all, verbose, filter
+	}, "", nil)
+	if err := list.Keyword(0, "all"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := list.Keyword(1, "verbose"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := list.Keyword(2, "bogus"); err == nil {
+		t.Errorf("string parameter was made a keyword")
+	}
+	reg := Registry()
+	reg.Add("list", list)
+
+	cases := []struct {
+		content      string
+		all, verbose bool
+	}{
+		{"!list x", false, false},
+		{"!list all x", true, false},
+		{"!list verbose x", false, true},
+		{"!list all verbose x", true, true},
+	}
+	for _, c := range cases {
+		if _, _, err := reg.Dispatch(s, testMessage(c.content), "!"); err != nil {
+			t.Errorf("'%s': unexpected error: %s", c.content, err)
+			continue
+		}
+		if gotAll != c.all || gotVerbose != c.verbose || gotFilter != "x" {
+			t.Errorf("'%s': expected (%v, %v, x) but got (%v, %v, %s)",
+				c.content, c.all, c.verbose, gotAll, gotVerbose, gotFilter)
+		}
+	}
+	if _, _, err := reg.Dispatch(s, testMessage("!list everything x"), "!"); !errors.As(err, &UnmarshalError{}) {
+		t.Errorf("expected UnmarshalError for mismatched keyword but got %v", err)
+	}
+	if _, _, err := reg.Dispatch(s, testMessage("!list all verbose x y"), "!"); err != (ArgCountMismatch{3, 4}) {
+		t.Errorf("expected ArgCountMismatch but got %v", err)
+	}
+	if expect := "`list [all] [verbose] <text>`"; list.usage("list") != expect {
+		t.Errorf("expected usage %q but got %q", expect, list.usage("list"))
+	}
+}
+
+func TestPermissionResolver(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	s.State.GuildAdd(&discordgo.Guild{ID: "guild", OwnerID: "owner"})
+	reg := Registry()
+	reg.Add("ban", MustPredicatedCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+	}, "", nil, CmdPredicate{Permissions: discordgo.PermissionBanMembers, AdministratorOverrides: true}))
+
+	granted := map[string]int{"mod": discordgo.PermissionBanMembers, "admin": discordgo.PermissionAdministrator}
+	reg.SetPermissionResolver(func(s *discordgo.Session, m *discordgo.MessageCreate, required int) (bool, error) {
+		if m.Author.ID == "broken" {
+			return false, errors.New("database is down")
+		}
+		return granted[m.Author.ID]&required != 0, nil
+	})
+
+	for user, expect := range map[string]error{
+		"mod":    nil,
+		"admin":  nil,
+		"nobody": AccessDenied{},
+		"owner":  AccessDenied{}, /* the resolver has the final say */
+	} {
+		m := testMessage("!ban")
+		m.GuildID, m.Author.ID = "guild", user
+		if _, _, err := reg.Dispatch(s, m, "!"); err != expect {
+			t.Errorf("%s: expected %v but got %v", user, expect, err)
+		}
+	}
+	m := testMessage("!ban")
+	m.GuildID, m.Author.ID = "guild", "broken"
+	if _, _, err := reg.Dispatch(s, m, "!"); err == nil || err.Error() != "database is down" {
+		t.Errorf("expected resolver error to be reported, got %v", err)
+	}
+}
+
+func TestDirectMessages(t *testing.T) {
+	s := testSession() /* no REST client, so any API call fails the test */
+	ran := false
+	reg := Registry()
+	reg.Add("kick", MustPredicatedCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+		ran = true
+	}, "", nil, CmdPredicate{Permissions: discordgo.PermissionKickMembers, AdministratorOverrides: true}))
+	reg.Add("ping", MustPredicatedCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+	}, "", nil, CmdPredicate{Cooldown: Cooldown(time.Hour)}))
+
+	if _, _, err := reg.Dispatch(s, testMessage("!kick"), "!"); err != (WrongContext{"in a server"}) || ran {
+		t.Errorf("expected permissioned command to be limited to servers, got %v", err)
+	}
+	if _, _, err := reg.Dispatch(s, testMessage("!ping"), "!"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if perm, err := MemberHasPermissions(s, "", "user", discordgo.PermissionKickMembers); perm || err != nil {
+		t.Errorf("expected no permissions outside of a guild, got (%v, %v)", perm, err)
+	}
+	if owner, err := IsOwner(s, "", "user"); owner || err != nil {
+		t.Errorf("expected no ownership outside of a guild, got (%v, %v)", owner, err)
+	}
+}
+
+func TestAvailableTo(t *testing.T) {
+	s := testSession()
+	noop := func(s *discordgo.Session, m *discordgo.MessageCreate) {}
+	reg := Registry()
+	reg.Add("ping", MustCommand(noop, "", nil))
+	reg.Add("kick", MustPredicatedCommand(noop, "", nil, CmdPredicate{Permissions: discordgo.PermissionKickMembers}))
+	reg.Add("mute", MustPredicatedCommand(noop, "", nil, CmdPredicate{
+		Permissions: discordgo.PermissionKickMembers,
+		Cooldown:    Cooldown(time.Hour),
+	}))
+	reg.Add("ban", MustPredicatedCommand(noop, "", nil, CmdPredicate{Permissions: discordgo.PermissionBanMembers}))
+	reg.Add("secret", WithPredicate(MustCommand(noop, "", nil), CmdPredicate{
+		Custom: func(s *discordgo.Session, m *discordgo.MessageCreate, p CmdPredicate) bool {
+			return false
+		},
+	}))
+	s.State.GuildAdd(&discordgo.Guild{ID: "guild", OwnerID: "owner"})
+
+	calls := 0
+	reg.SetPermissionResolver(func(s *discordgo.Session, m *discordgo.MessageCreate, required int) (bool, error) {
+		calls++
+		return required == discordgo.PermissionKickMembers, nil
+	})
+	m := testMessage("!help")
+	m.GuildID = "guild"
+	for c := 0; c < 2; c++ { /* the cooldown shouldn't be consumed */
+		if got, expect := reg.AvailableTo(s, m), []string{"kick", "mute", "ping"}; !reflect.DeepEqual(got, expect) {
+			t.Errorf("expected %v but got %v", expect, got)
+		}
+	}
+	if calls != 4 {
+		t.Errorf("expected permissions to be resolved once per call and bitmask, got %d calls", calls)
+	}
+}
+
+func TestSuppressMentions(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	reg := Registry()
+	reg.SuppressMentions = true
+	reg.Add("echo", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, words []string) string {
+		return strings.Join(words, " ")
+	}, "", nil))
+	allowed := &discordgo.MessageSend{
+		Content:         "<@user>",
+		AllowedMentions: &discordgo.MessageAllowedMentions{Users: []string{"user"}},
+	}
+	reg.Add("poke", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) *discordgo.MessageSend {
+		return allowed
+	}, "", nil))
+
+	for content, expect := range map[string]string{
+		"!echo @everyone": `"allowed_mentions":{"parse":[]}`,
+		"!poke":           `"allowed_mentions":{"parse":null,"users":["user"]}`,
+	} {
+		reqs = nil
+		if _, _, err := reg.Dispatch(s, testMessage(content), "!"); err != nil {
+			t.Fatalf("%q: unexpected error: %s", content, err)
+		}
+		body, _ := ioutil.ReadAll(reqs[0].Body)
+		if !strings.Contains(string(body), expect) {
+			t.Errorf("%q: expected request body to contain %s, got %s", content, expect, body)
+		}
+	}
+}
+
+func TestShorthand(t *testing.T) {
+	s := testSession()
+	var got [3]bool
+	var gotTarget string
+	var gotN int
+	build := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, target string, x, v bool, n int, f bool) {
+		gotTarget, gotN = target, n
+		got = [3]bool{x, v, f}
+	}, "", nil)
+	for param, letter := range map[int]rune{1: 'x', 2: 'v', 4: 'f'} {
+		if err := build.Shorthand(param, letter); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := build.Shorthand(0, 'y'); err == nil {
+		t.Errorf("string parameter was given a shorthand")
+	}
+	if err := build.Shorthand(1, 'y'); err == nil {
+		t.Errorf("parameter was given two shorthands")
+	}
+	reg := Registry()
+	reg.Add("build", build)
+
+	cases := map[string][3]bool{
+		"!build all -3":          {false, false, false},
+		"!build all -3 -xvf":     {true, true, true},
+		"!build all -3 -v -f":    {false, true, true},
+		"!build all -3 -fx -xxf": {true, false, true},
+	}
+	for content, expect := range cases {
+		got, gotTarget, gotN = [3]bool{}, "", 0
+		if _, _, err := reg.Dispatch(s, testMessage(content), "!"); err != nil {
+			t.Errorf("%q: unexpected error: %s", content, err)
+		} else if got != expect || gotTarget != "all" || gotN != -3 {
+			t.Errorf("%q: expected (all, -3, %v) but got (%s, %d, %v)", content, expect, gotTarget, gotN, got)
+		}
+	}
+	if _, _, err := reg.Dispatch(s, testMessage("!build all -3 -xz"), "!"); err != (ArgCountMismatch{2, 3}) {
+		t.Errorf("expected unknown flag to be taken positionally, got %v", err)
+	}
+	if expect := "`build <text> [-x] [-v] <number> [-f]`"; build.usage("build") != expect {
+		t.Errorf("expected usage %q but got %q", expect, build.usage("build"))
+	}
+}
+
+type testDB struct{ name string }
+
+func TestInjectType(t *testing.T) {
+	s := testSession()
+	fn := func(s *discordgo.Session, m *discordgo.MessageCreate, id RequestID, db *testDB, key string) string {
+		return db.name + ":" + key
+	}
+	if _, err := Command(fn, "", nil); err == nil {
+		t.Errorf("unregistered dependency was accepted as a parameter")
+	}
+	InjectType((*testDB)(nil))
+	defer injectTypes.Delete(reflect.TypeOf((*testDB)(nil)))
+	var got string
+	cmd := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, id RequestID, db *testDB, key string) {
+		got = fn(s, m, id, db, key)
+	}, "", nil)
+	reg := Registry()
+	reg.Add("get", cmd)
+
+	if _, _, err := reg.Dispatch(s, testMessage("!get key"), "!"); err == nil {
+		t.Errorf("command was invoked without dependencies")
+	}
+	reg.Deps = &testDB{"main"}
+	if _, _, err := reg.Dispatch(s, testMessage("!get key"), "!"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != "main:key" {
+		t.Errorf("expected main:key but got %s", got)
+	}
+	reg.Deps = "wrong"
+	if _, _, err := reg.Dispatch(s, testMessage("!get key"), "!"); err == nil {
+		t.Errorf("dependency of the wrong type was injected")
+	}
+}
+
+func TestMaxLength(t *testing.T) {
+	s := testSession()
+	warn := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, who string, reason []string) {
+	}, "", nil)
+	if err := warn.MaxLength(0, 5); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := warn.MaxLength(1, 8); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := warn.MaxLength(2, 8); err == nil {
+		t.Errorf("limited a parameter that doesn't exist")
+	}
+	reg := Registry()
+	reg.Add("warn", warn)
+
+	for content, expect := range map[string]error{
+		"!warn ñandú being rude":         nil,
+		"!warn someone being rude":       ArgTooLong{0, 5, 7},
+		"!warn bob being extremely rude": ArgTooLong{1, 8, 9},
+	} {
+		if _, _, err := reg.Dispatch(s, testMessage(content), "!"); err != expect {
+			t.Errorf("%q: expected %v but got %v", content, expect, err)
+		}
+	}
+}
+
+func TestStateWait(t *testing.T) {
+	s := testSession()
+	var found bool
+	reg := Registry()
+	reg.Add("info", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+		_, err := s.State.Guild(m.GuildID)
+		found = err == nil
+	}, "", nil))
+	m := testMessage("!info")
+	m.GuildID = "guild"
+
+	reg.StateWait = 20 * time.Millisecond
+	start := time.Now()
+	reg.Dispatch(s, m, "!")
+	if found || time.Since(start) < reg.StateWait {
+		t.Errorf("expected command to run after waiting for state in vain")
+	}
+
+	reg.StateWait = time.Second
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.State.GuildAdd(&discordgo.Guild{ID: "guild"})
+	}()
+	reg.Dispatch(s, m, "!")
+	if !found {
+		t.Errorf("expected command to run once the guild was in state")
+	}
+}
+
+func TestExclusive(t *testing.T) {
+	s := testSession()
+	started, finish := make(chan struct{}), make(chan struct{})
+	turn := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, panics bool) {
+		if panics {
+			panic("oops")
+		}
+		close(started)
+		<-finish
+	}, "", nil)
+	turn.Exclusive = true
+	reg := Registry()
+	reg.Add("turn", turn)
+
+	done := make(chan error)
+	go func() {
+		_, _, err := reg.Dispatch(s, testMessage("!turn false"), "!")
+		done <- err
+	}()
+	<-started
+	if _, _, err := reg.Dispatch(s, testMessage("!turn false"), "!"); err != (AlreadyRunning{}) {
+		t.Errorf("expected AlreadyRunning but got %v", err)
+	}
+	other := testMessage("!turn true")
+	other.Author.ID = "other"
+	if _, _, err := reg.Dispatch(s, other, "!"); err == nil || err == (AlreadyRunning{}) {
+		t.Errorf("expected another user's invocation to run (and panic), got %v", err)
+	}
+	close(finish)
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, _, err := reg.Dispatch(s, other, "!"); err == (AlreadyRunning{}) {
+		t.Errorf("invocation wasn't cleared after panicking")
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	s := testSession()
+	var ran string
+	cmd := func(name string) Cmd {
+		return MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+			ran = name
+		}, "", nil)
+	}
+	base := Registry()
+	base.Add("ping", cmd("base ping"))
+	base.Add("help", cmd("base help"))
+	base.Alias("p", "ping")
+	guild := base.Overlay()
+	guild.Add("ping", cmd("guild ping"))
+	guild.Add("tag", cmd("guild tag"))
+	guild.Alias("h", "help")
+	base.Add("late", cmd("base late"))
+
+	for content, expect := range map[string]string{
+		"!ping": "guild ping",
+		"!p":    "guild ping",
+		"!help": "base help",
+		"!h":    "base help",
+		"!tag":  "guild tag",
+		"!late": "base late",
+	} {
+		ran = ""
+		if handled, _, err := guild.Dispatch(s, testMessage(content), "!"); !handled || err != nil || ran != expect {
+			t.Errorf("%q: expected %s to run, got (%v, %v) and %q", content, expect, handled, err, ran)
+		}
+	}
+	ran = ""
+	if base.Dispatch(s, testMessage("!ping"), "!"); ran != "base ping" {
+		t.Errorf("overlay changed the base register")
+	}
+	if handled, _, _ := base.Dispatch(s, testMessage("!tag"), "!"); handled {
+		t.Errorf("overlay command leaked into the base register")
+	}
+	if expect := "help [h]\nlate\nping [p]\ntag\n"; guild.Tree() != expect {
+		t.Errorf("expected tree\n%s\nbut got\n%s", expect, guild.Tree())
+	}
+}
+
+func TestIntegerLiterals(t *testing.T) {
+	valOf := reflect.ValueOf
+	vals := map[string]reflect.Value{
+		"0xFF":     valOf(255),
+		"0o17":     valOf(int64(15)),
+		"0b1010":   valOf(uint8(10)),
+		"-0x10":    valOf(int16(-16)),
+		"007":      valOf(7),
+		"1_000":    valOf(uint(1000)),
+		"0xFF0000": valOf(uint32(0xFF0000)),
+	}
+	for str, val := range vals {
+		actual, err := tryConvert(nil, nil, val.Type(), str)
+		if err != nil {
+			t.Errorf("errored out for value '%v' of expected type '%s': %s", str, val.Type(), err)
+		} else if val.Interface() != actual.Interface() {
+			t.Errorf("expected '%v' but got '%v' for '%s'", val, actual, str)
+		}
+	}
+	for str, ttype := range map[string]reflect.Type{
+		"0xZZ":  reflect.TypeOf(0),
+		"0x100": reflect.TypeOf(uint8(0)),
+		"-1":    reflect.TypeOf(uint(0)),
+		"1.5":   reflect.TypeOf(0),
+	} {
+		if _, err := tryConvert(nil, nil, ttype, str); !errors.As(err, &UnmarshalError{}) {
+			t.Errorf("expected UnmarshalError for '%s' as %s but got %v", str, ttype, err)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	s := testSession()
+	s.State.GuildAdd(&discordgo.Guild{ID: "guild", OwnerID: "owner"})
+	s.State.ChannelAdd(&discordgo.Channel{ID: "chan", GuildID: "guild"})
+	noop := func(s *discordgo.Session, m *discordgo.MessageCreate) {}
+	reg := Registry()
+	reg.Add("ping", MustCommand(noop, "", nil))
+	reg.Add("ban", MustPredicatedCommand(noop, "", nil, CmdPredicate{
+		Permissions: discordgo.PermissionBanMembers | discordgo.PermissionKickMembers,
+	}))
+	reg.Add("reply", MustPredicatedCommand(noop, "", nil, CmdPredicate{ThreadOnly: true}))
+	reg.Add("nope", MustPredicatedCommand(noop, "", nil, CmdPredicate{
+		Custom: func(s *discordgo.Session, m *discordgo.MessageCreate, p CmdPredicate) bool {
+			return false
+		},
+	}))
+	reg.Add("daily", MustPredicatedCommand(noop, "", nil, CmdPredicate{Cooldown: Cooldown(time.Hour)}))
+	reg.SetPermissionResolver(func(s *discordgo.Session, m *discordgo.MessageCreate, required int) (bool, error) {
+		return false, nil
+	})
+
+	m := testMessage("!why")
+	m.GuildID, m.ChannelID, m.Author.ID = "guild", "chan", "other"
+	if _, _, err := reg.Dispatch(s, testMessage("!daily"), "!"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cases := []struct {
+		name    string
+		allowed bool
+		reason  string
+	}{
+		{"ping", true, "all of its requirements are met"},
+		{"bogus", false, "there's no command named bogus"},
+		{"ban", false, "it requires any of these permissions: Kick Members, Ban Members"},
+		{"reply", false, "it can only be used in a thread"},
+		{"nope", false, "it was denied by the command's own check"},
+		{"daily", true, "all of its requirements are met"},
+	}
+	for _, c := range cases {
+		if allowed, reason := reg.Explain(s, m, c.name); allowed != c.allowed || reason != c.reason {
+			t.Errorf("%s: expected (%v, %q) but got (%v, %q)", c.name, c.allowed, c.reason, allowed, reason)
+		}
+	}
+	if allowed, reason := reg.Explain(s, testMessage("!why daily"), "daily"); allowed || !strings.HasPrefix(reason, "it's on cooldown") {
+		t.Errorf("expected cooldown to be explained, got (%v, %q)", allowed, reason)
+	}
+	if _, _, err := reg.Dispatch(s, testMessage("!ban"), "!"); err != (WrongContext{"in a server"}) {
+		t.Errorf("expected WrongContext but got %v", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	noop := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {}, "", nil)
+	bot := Registry()
+	bot.Add("ping", noop)
+	music := Registry()
+	music.Add("play", noop)
+	music.Add("skip", noop)
+	music.Alias("p", "play")
+	mod := Registry()
+	mod.Add("ban", noop)
+	mod.Add("play", noop)
+	mod.Add("ping", noop)
+
+	if err := bot.Merge(music); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if bot.Get("p") == nil || bot.Get("skip") == nil {
+		t.Errorf("commands weren't merged")
+	}
+	err := bot.Merge(mod)
+	if conflict, ok := err.(MergeConflict); !ok || !reflect.DeepEqual(conflict.Names, []string{"ping", "play"}) {
+		t.Errorf("expected conflicts [ping play] but got %v", err)
+	}
+	if bot.Get("ban") != nil {
+		t.Errorf("register was partially merged")
+	}
+	if err := bot.Merge(bot); err == nil {
+		t.Errorf("register was merged into itself")
+	}
+
+	/* Merging registers into each other at once shouldn't deadlock */
+	a, b := Registry(), Registry()
+	a.Add("a", noop)
+	b.Add("b", noop)
+	done := make(chan bool)
+	for c := 0; c < 100; c++ {
+		go func() { a.Merge(b); done <- true }()
+		go func() { b.Merge(a); done <- true }()
+		<-done
+		<-done
+	}
+}
+
+func TestFileThreshold(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	reg := Registry()
+	reg.FileThreshold = 10
+	reg.Webhooks = map[string]CmdWebhook{"hooked": {ID: "1", Token: "token"}}
+	reg.Add("dump", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, words []string) string {
+		return strings.Join(words, " ")
+	}, "", nil))
+
+	cases := []struct {
+		content, channel, path string
+		file                   bool
+	}{
+		{"!dump short", "plain", "/channels/plain/messages", false},
+		{"!dump rather long output", "plain", "/channels/plain/messages", true},
+		{"!dump rather long output", "hooked", "/channels/hooked/messages", true},
+		{"!dump short", "hooked", "/webhooks/1/token", false},
+	}
+	for _, c := range cases {
+		reqs = nil
+		m := testMessage(c.content)
+		m.ChannelID = c.channel
+		if _, _, err := reg.Dispatch(s, m, "!"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		body, _ := ioutil.ReadAll(reqs[0].Body)
+		file := strings.Contains(string(body), `filename="output.txt"`)
+		if !strings.HasSuffix(reqs[0].URL.Path, c.path) || file != c.file {
+			t.Errorf("%q in %s: expected reply to %s (as file: %v), got %s (as file: %v)",
+				c.content, c.channel, c.path, c.file, reqs[0].URL.Path, file)
+		}
+	}
+}
+
+func TestExec(t *testing.T) {
+	s := testSession()
+	var got []string
+	reg := Registry()
+	reg.Add("echo", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, words []string) {
+		got = words
+	}, "", nil))
+	reg.Alias("say", "echo")
+	reg.Add("secret", MustPredicatedCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+	}, "", nil, CmdPredicate{
+		Custom: func(s *discordgo.Session, m *discordgo.MessageCreate, p CmdPredicate) bool {
+			return false
+		},
+	}))
+
+	if err := reg.Exec(s, testMessage(""), "say", "hello world", "again"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(got, []string{"hello world", "again"}) {
+		t.Errorf("expected [hello world again] but got %q", got)
+	}
+	if err := reg.Exec(s, testMessage(""), "secret"); err != (AccessDenied{}) {
+		t.Errorf("expected AccessDenied but got %v", err)
+	}
+	if err := reg.Exec(s, testMessage(""), "bogus"); err != (NoSuchCommand{"bogus"}) {
+		t.Errorf("expected NoSuchCommand but got %v", err)
+	}
+}
+
+func TestInCategory(t *testing.T) {
+	s := testSession()
+	s.State.GuildAdd(&discordgo.Guild{
+		ID: "guild",
+		Channels: []*discordgo.Channel{
+			{ID: "staff", GuildID: "guild", Type: discordgo.ChannelTypeGuildCategory, Name: "Staff"},
+			{ID: "mods", GuildID: "guild", Type: discordgo.ChannelTypeGuildText, ParentID: "staff"},
+			{ID: "cases", GuildID: "guild", Type: channelTypeGuildPublicThread, ParentID: "mods"},
+			{ID: "general", GuildID: "guild", Type: discordgo.ChannelTypeGuildText},
+		},
+	})
+
+	pred := InCategory("staff")
+	for channel, allow := range map[string]bool{"mods": true, "cases": true, "general": false} {
+		m := testMessage("")
+		m.GuildID, m.ChannelID = "guild", channel
+		err := pred.Check(s, m)
+		if allow && err != nil || !allow && err != (WrongContext{"in the Staff category"}) {
+			t.Errorf("category predicate in %s channel: got %v", channel, err)
+		}
+	}
+}
+
+func TestTransientLookup(t *testing.T) {
+	reg := Registry()
+	reg.Add("whois", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, u *discordgo.User) {
+	}, "", nil))
+
+	for status, transient := range map[int]bool{
+		http.StatusNotFound:            false,
+		http.StatusInternalServerError: true,
+	} {
+		s := testStatusSession(status)
+		var uerr UnmarshalError
+		if err := reg.Exec(s, testMessage(""), "whois", "<@!1234>"); !errors.As(err, &uerr) {
+			t.Errorf("%d: expected UnmarshalError but got %v", status, err)
+		} else if uerr.Transient != transient {
+			t.Errorf("%d: expected Transient to be %t", status, transient)
+		}
+	}
+}
+
+func TestWarmGuilds(t *testing.T) {
+	var lists int
+	s := testGuildSession(&lists)
+	reg := Registry()
+	reg.WarmGuilds = true
+	reg.Add("ping", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+	}, "", nil))
+
+	for c := 0; c < 2; c++ {
+		m := testMessage("")
+		m.GuildID = "guild"
+		if err := reg.Exec(s, m, "ping"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if _, err := s.State.Member("guild", "user"); err != nil {
+		t.Errorf("expected guild to be warmed: %s", err)
+	}
+	if lists != 1 {
+		t.Errorf("expected guild to be warmed once, listed members %d times", lists)
+	}
+}
+
+func TestNotFoundMessages(t *testing.T) {
+	reg := Registry()
+	reg.NotFoundMessages = map[reflect.Type]string{
+		reflect.TypeOf(&discordgo.User{}): "I couldn't find that user",
+	}
+	reg.Add("whois", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, u *discordgo.User) {
+	}, "", nil))
+
+	err := reg.Exec(testStatusSession(http.StatusNotFound), testMessage(""), "whois", "<@!1234>")
+	if msg, ok := publicMessage(err); !ok || msg != "I couldn't find that user" {
+		t.Errorf("expected not found message but got %v", err)
+	}
+	err = reg.Exec(testStatusSession(http.StatusInternalServerError), testMessage(""), "whois", "<@!1234>")
+	if _, ok := publicMessage(err); ok {
+		t.Errorf("expected no message for transient error, got %v", err)
+	}
+}
+
+func TestBeforeArg(t *testing.T) {
+	s := testSession()
+	var got interface{}
+	give := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, kind string, what interface{}) {
+		got = what
+	}, "", nil)
+	give.BeforeArg = func(index int, parsed []reflect.Value, raw string) (reflect.Type, error) {
+		if index != 1 {
+			return nil, nil
+		}
+		switch parsed[0].String() {
+		case "coins":
+			return reflect.TypeOf(0), nil
+		case "color":
+			return reflect.TypeOf(Color(0)), nil
+		case "nothing":
+			return nil, errors.New("can't give nothing")
+		case "bogus":
+			return reflect.TypeOf([]int{}), nil
+		}
+		return nil, nil
+	}
+	reg := Registry()
+	reg.Add("give", give)
+
+	for args, expect := range map[[2]string]interface{}{
+		{"coins", "42"}:   42,
+		{"color", "red"}:  Color(0xff0000),
+		{"item", "sword"}: "sword",
+	} {
+		if err := reg.Exec(s, testMessage(""), "give", args[0], args[1]); err != nil {
+			t.Errorf("%q: unexpected error: %s", args, err)
+		} else if got != expect {
+			t.Errorf("%q: expected %#v but got %#v", args, expect, got)
+		}
+	}
+	for _, args := range [][]string{{"coins", "many"}, {"nothing", "at all"}, {"bogus", "1"}} {
+		if err := reg.Exec(s, testMessage(""), "give", args...); !errors.As(err, &UnmarshalError{}) {
+			t.Errorf("%q: expected UnmarshalError but got %v", args, err)
+		}
+	}
+	if usage := give.usage("give"); !strings.HasPrefix(usage, "`give <text> <any>`") {
+		t.Errorf("unexpected usage %q", usage)
+	}
+}
+
+func TestErrorReturns(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	failure := errors.New("out of coffee")
+	var handled error
+	reg := Registry()
+	reg.Add("brew", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, fail bool) error {
+		if fail {
+			return failure
+		}
+		return nil
+	}, "", func(s *discordgo.Session, m *discordgo.MessageCreate, err error) {
+		handled = err
+	}))
+	reg.Add("pour", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, fail bool) (string, error) {
+		if fail {
+			return "not sent", failure
+		}
+		return "here you go", nil
+	}, "", nil))
+
+	reg.Handle(s, testMessage("!brew true"), "!", nil)
+	if !errors.Is(handled, failure) {
+		t.Errorf("expected error handler to get %v, got %v", failure, handled)
+	}
+	if err := reg.Exec(s, testMessage(""), "brew", "false"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := reg.Exec(s, testMessage(""), "pour", "true"); err != failure {
+		t.Errorf("expected %v but got %v", failure, err)
+	}
+	if len(reqs) != 0 {
+		t.Errorf("expected no reply alongside an error, got %d requests", len(reqs))
+	}
+	if err := reg.Exec(s, testMessage(""), "pour", "false"); err != nil || len(reqs) != 1 {
+		t.Errorf("expected a reply, got %v and %d requests", err, len(reqs))
+	}
+
+	for _, fn := range []interface{}{
+		func(s *discordgo.Session, m *discordgo.MessageCreate) (error, string) { return nil, "" },
+		func(s *discordgo.Session, m *discordgo.MessageCreate) (error, error) { return nil, nil },
+		func(s *discordgo.Session, m *discordgo.MessageCreate) (int, error) { return 0, nil },
+	} {
+		if _, err := Command(fn, "", nil); err == nil {
+			t.Errorf("expected %T to be rejected", fn)
+		}
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	s := testSession()
+	reg := Registry()
+	reg.Add("base", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+	}, "", nil))
+
+	var wg sync.WaitGroup
+	for c := 0; c < 8; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				name := fmt.Sprintf("cmd%d_%d", c, i)
+				if err := reg.Add(name, MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+				}, "", nil)); err != nil {
+					t.Errorf("unexpected error: %s", err)
+					return
+				}
+				if err := reg.Alias("alias"+name, name); err != nil {
+					t.Errorf("unexpected error: %s", err)
+					return
+				}
+				if reg.Get("alias"+name) == nil || reg.Canon("alias"+name) != name {
+					t.Errorf("%s wasn't added", name)
+				}
+			}
+		}(c)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if handled, _, err := reg.Dispatch(s, testMessage("!base"), "!"); !handled || err != nil {
+					t.Errorf("unexpected dispatch result (%v, %v)", handled, err)
+				}
+				reg.Snapshot()
+				reg.AvailableTo(s, testMessage(""))
+			}
+		}()
+	}
+	wg.Wait()
+	if cmds := len(reg.Snapshot().Cmds); cmds != 801 {
+		t.Errorf("expected 801 commands, got %d", cmds)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	reg := Registry()
+	reg.Add("echo", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+	}, "", nil))
+	reg.Add("ping", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+	}, "", nil))
+	reg.Alias("say", "echo")
+	reg.Alias("repeat", "echo")
+	reg.Alias("p", "ping")
+
+	if err := reg.Unalias("ping"); err == nil {
+		t.Errorf("expected error unaliasing a command")
+	}
+	if err := reg.Unalias("p"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if reg.Get("p") != nil || reg.Get("ping") == nil {
+		t.Errorf("expected only the alias to be removed")
+	}
+
+	if err := reg.Remove("say"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	for _, name := range []string{"echo", "say", "repeat"} {
+		if reg.Get(name) != nil {
+			t.Errorf("expected %s to be removed", name)
+		}
+	}
+	if err := reg.Remove("echo"); err == nil {
+		t.Errorf("expected error removing a missing command")
+	}
+	if err := reg.Add("echo", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+	}, "", nil)); err != nil {
+		t.Errorf("expected name to be free after removal, got %s", err)
+	}
+
+	overlay := reg.Overlay()
+	if err := overlay.Remove("ping"); err == nil || reg.Get("ping") == nil {
+		t.Errorf("expected parent's command to be left alone, got %v", err)
+	}
+}
+
+func TestMultiPrefix(t *testing.T) {
+	s := testSession()
+	var got []string
+	reg := Registry()
+	reg.Add("ping", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+		got = append(got, "ping")
+	}, "", nil))
+	reg.Add("!ping", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+		got = append(got, "!ping")
+	}, "", nil))
+	handle := reg.MultiPrefixHandler([]string{"!", "?", "!!"}, func(s *discordgo.Session, m *discordgo.MessageCreate, err error) {
+		t.Errorf("unexpected error: %s", err)
+	})
+
+	for _, content := range []string{"!ping", "?ping", "!!ping", "ping", ".ping"} {
+		handle(s, testMessage(content))
+	}
+	if expect := []string{"ping", "ping", "ping"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected %q but got %q", expect, got)
+	}
+}
+
+func TestMentionPrefix(t *testing.T) {
+	s := testSession()
+	var got []string
+	reg := Registry()
+	reg.Add("help", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+		got = append(got, strings.Join(args, " "))
+	}, "", nil))
+
+	if handled, _, _ := reg.Dispatch(s, testMessage("<@bot> help"), "!"); handled {
+		t.Errorf("mention handled without MentionPrefix")
+	}
+	reg.MentionPrefix = true
+	for content, handled := range map[string]bool{
+		"<@bot> help me":      true,
+		"<@!bot>\n  help me":  true,
+		"<@bot>help me":       true,
+		"!help me":            true,
+		"hey <@bot> help me":  false,
+		"<@other> help me":    false,
+		"<@botanist> help me": false,
+		" <@bot> help me":     false,
+		"<@bot>":              false,
+	} {
+		got = nil
+		if ok, _, err := reg.Dispatch(s, testMessage(content), "!"); ok != handled || err != nil {
+			t.Errorf("%q: expected handled to be %t, got (%v, %v)", content, handled, ok, err)
+		} else if handled && !reflect.DeepEqual(got, []string{"me"}) {
+			t.Errorf("%q: expected [me] but got %q", content, got)
+		}
+	}
+}
+
+func TestHandlerFunc(t *testing.T) {
+	s := testSession()
+	var got []string
+	reg := Registry()
+	reg.Add("ping", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+		got = append(got, m.GuildID)
+	}, "", nil))
+	prefixes := map[string]string{"a": "!", "b": "?"}
+	handle := reg.HandlerFunc(func(s *discordgo.Session, m *discordgo.MessageCreate) string {
+		return prefixes[m.GuildID]
+	}, nil)
+
+	for _, c := range []struct{ guild, content string }{
+		{"a", "!ping"},
+		{"a", "?ping"},
+		{"b", "?ping"},
+		{"b", "!ping"},
+		{"c", "ping"},
+		{"c", "!ping"},
+	} {
+		m := testMessage(c.content)
+		m.GuildID = c.guild
+		handle(s, m)
+	}
+	if expect := []string{"a", "b"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected %q but got %q", expect, got)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	s := testSession()
+	newCmd := func() Cmd {
+		return MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {}, "", nil)
+	}
+	reg := Registry()
+	reg.Add("Help", newCmd())
+	if err := reg.Add("help", newCmd()); err != nil {
+		t.Errorf("expected case-sensitive register to accept help, got %s", err)
+	}
+
+	reg = Registry()
+	reg.CaseInsensitive = true
+	reg.Add("Help", newCmd())
+	if err := reg.Add("help", newCmd()); err == nil {
+		t.Errorf("expected help to conflict with Help")
+	}
+	if err := reg.Alias("H", "HELP"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := reg.Alias("h", "help"); err == nil {
+		t.Errorf("expected h to conflict with H")
+	}
+	for _, content := range []string{"!help", "!HELP", "!hElP", "!h", "!H"} {
+		if handled, name, err := reg.Dispatch(s, testMessage(content), "!"); !handled || name != "help" || err != nil {
+			t.Errorf("%q: expected help to run, got (%v, %q, %v)", content, handled, name, err)
+		}
+	}
+	if err := reg.Unalias("h"); err != nil || reg.Get("H") != nil {
+		t.Errorf("expected alias to be removed, got %v", err)
+	}
+	if err := reg.Remove("HELP"); err != nil || reg.Get("help") != nil {
+		t.Errorf("expected command to be removed, got %v", err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	ban := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, who *discordgo.User, days int, reason []string) {
+	}, "", nil)
+	expect := []reflect.Type{reflect.TypeOf(&discordgo.User{}), reflect.TypeOf(0), reflect.TypeOf([]string{})}
+	if sig := ban.Signature(); !reflect.DeepEqual(sig, expect) {
+		t.Errorf("expected signature %v but got %v", expect, sig)
+	}
+	if usage := ban.Usage("ban"); usage != "ban <user> <number> <text...>" {
+		t.Errorf("unexpected usage %q", usage)
+	}
+
+	misc := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate,
+		msg *discordgo.Message, r RoleID, tz *time.Location, c Color, ratio float64) {
+	}, "", nil)
+	if usage := misc.Usage("misc"); usage != "misc <message link> <role> <time zone> <color> <number>" {
+		t.Errorf("unexpected usage %q", usage)
+	}
+}
+
+func TestCustomPredicate(t *testing.T) {
+	s := testSession()
+	pred := CmdPredicate{Custom: func(s *discordgo.Session, m *discordgo.MessageCreate, p CmdPredicate) bool {
+		return m.Author.ID == "staff"
+	}}
+	for author, allow := range map[string]bool{"staff": true, "user": false} {
+		m := testMessage("")
+		m.Author.ID = author
+		err := pred.Check(s, m)
+		if allow && err != nil || !allow && err != (AccessDenied{}) {
+			t.Errorf("custom predicate for %s: got %v", author, err)
+		}
+	}
+}
+
+func TestVariadic(t *testing.T) {
+	var got []int
+	sum := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, label string, nums ...int) {
+		got = nums
+	}, "", nil)
+	if usage := sum.Usage("sum"); usage != "sum <text> <number...>" {
+		t.Errorf("unexpected usage %q", usage)
+	}
+
+	reg := Registry()
+	reg.Add("sum", sum)
+	s := testSession()
+	for args, expect := range map[string][]int{"total 1 2 3": {1, 2, 3}, "total": {}} {
+		got = nil
+		err := reg.Exec(s, testMessage(""), "sum", strings.Fields(args)...)
+		if err != nil || len(got) != len(expect) || len(got) != 0 && !reflect.DeepEqual(got, expect) {
+			t.Errorf("%q: expected %v, got (%v, %v)", args, expect, got, err)
+		}
+	}
+
+	if _, err := Command(func(s *discordgo.Session, m *discordgo.MessageCreate, c ...chan int) {}, "", nil); err == nil {
+		t.Errorf("expected variadic channels to be rejected")
+	}
+}
+
+func TestOptional(t *testing.T) {
+	type poll struct {
+		question string
+		duration time.Duration
+		choices  int
+	}
+	var got poll
+	cmd := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate,
+		question string, duration time.Duration, choices int) {
+		got = poll{question, duration, choices}
+	}, "", nil)
+	if err := cmd.Optional(1); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if usage := cmd.Usage("poll"); usage != "poll <text> [duration] [number]" {
+		t.Errorf("unexpected usage %q", usage)
+	}
+
+	s := testSession()
+	reg := Registry()
+	reg.Add("poll", cmd)
+	cases := []struct {
+		args   []string
+		expect poll
+	}{
+		{[]string{"lunch?"}, poll{"lunch?", 0, 0}},
+		{[]string{"lunch?", "1h"}, poll{"lunch?", time.Hour, 0}},
+		{[]string{"lunch?", "1h", "3"}, poll{"lunch?", time.Hour, 3}},
+	}
+	for _, c := range cases {
+		got = poll{}
+		if err := reg.Exec(s, testMessage(""), "poll", c.args...); err != nil || got != c.expect {
+			t.Errorf("%q: expected %v but got (%v, %v)", c.args, c.expect, got, err)
+		}
+	}
+	if err := reg.Exec(s, testMessage(""), "poll"); err != (ArgCountMismatch{1, 0}) {
+		t.Errorf("expected ArgCountMismatch but got %v", err)
+	}
+	if err := reg.Exec(s, testMessage(""), "poll", "a", "1h", "3", "b"); err != (ArgCountMismatch{3, 4}) {
+		t.Errorf("expected ArgCountMismatch but got %v", err)
+	}
+
+	if err := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, rest []string) {}, "", nil).Optional(0); err == nil {
+		t.Errorf("expected trailing slices not to be made optional")
+	}
+}
+
+func TestReportUnknown(t *testing.T) {
+	s := testSession()
+	reg := Registry()
+	reg.ReportUnknown = true
+	reg.Add("echo", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, str string) {}, "", nil))
+
+	var reported []error
+	handler := func(s *discordgo.Session, m *discordgo.MessageCreate, err error) {
+		reported = append(reported, err)
+	}
+	for _, content := range []string{"hello there", "!", "!echo hi", "!bogus", "echo hi"} {
+		reg.Handle(s, testMessage(content), "!", handler)
+	}
+	if len(reported) != 1 || !errors.Is(reported[0], NoSuchCommand{"bogus"}) {
+		t.Errorf("expected only !bogus to be reported, got %v", reported)
+	}
+	if handled, _, err := reg.Dispatch(s, testMessage("!bogus"), "!"); handled || err != (NoSuchCommand{"bogus"}) {
+		t.Errorf("expected NoSuchCommand but got (%v, %v)", handled, err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	type key struct{}
+	var value interface{}
+	var cause error
+	reg := Registry()
+	reg.BaseContext = context.WithValue(context.Background(), key{}, "base")
+	reg.Timeout = 10 * time.Millisecond
+	reg.Add("slow", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, ctx context.Context, id RequestID) {
+		value = ctx.Value(key{})
+		select {
+		case <-ctx.Done():
+			cause = ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}, "", nil))
+
+	if err := reg.Exec(testSession(), testMessage(""), "slow"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if value != "base" || cause != context.DeadlineExceeded {
+		t.Errorf("expected a context derived from BaseContext timing out, got (%v, %v)", value, cause)
+	}
+
+	var leaked context.Context
+	plain := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, ctx context.Context) {
+		leaked = ctx
+	}, "", nil)
+	if err := plain.Invoke(testSession(), testMessage(""), nil); err != nil || leaked == nil || leaked.Err() != context.Canceled {
+		t.Errorf("expected context to be cancelled once the command returned, got %v", err)
+	}
+}
+
+type panickingCmd struct{}
+
+func (panickingCmd) Invoke(s *discordgo.Session, m *discordgo.MessageCreate, args []string) error {
+	panic("oops")
+}
+
+func (panickingCmd) ErrorHandler() CmdErrorHandler {
+	return nil
+}
+
+func TestAsyncHandler(t *testing.T) {
+	s := testSession()
+	release, done := make(chan struct{}), make(chan struct{})
+	reg := Registry()
+	reg.Add("slow", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+		<-release
+		close(done)
+	}, "", nil))
+	reg.Add("broken", panickingCmd{})
+	errs := make(chan error, 1)
+	handle := reg.AsyncHandler("!", func(s *discordgo.Session, m *discordgo.MessageCreate, err error) {
+		errs <- err
+	})
+
+	/* Would deadlock if the command ran synchronously */
+	handle(s, testMessage("!slow"))
+	close(release)
+	<-done
+
+	handle(s, testMessage("!broken"))
+	select {
+	case err := <-errs:
+		if err == nil || !strings.Contains(err.Error(), "oops") {
+			t.Errorf("expected the panic to be reported, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("panic wasn't reported")
+	}
+}
+
+func TestBool(t *testing.T) {
+	type toggle bool
+	for str, expect := range map[string]bool{
+		"true": true, "Yes": true, "ON": true, "1": true, "enable": true,
+		"false": false, "no": false, "Off": false, "0": false, "DISABLE": false,
+	} {
+		val, err := tryConvert(nil, nil, reflect.TypeOf(toggle(false)), str)
+		if err != nil || val.Interface() != toggle(expect) {
+			t.Errorf("%q: expected %v but got (%v, %v)", str, expect, val, err)
+		}
+	}
+	if _, err := tryConvert(nil, nil, reflect.TypeOf(false), "maybe"); err == nil {
+		t.Errorf("expected maybe to be rejected")
+	} else if _, ok := err.(UnmarshalError); !ok {
+		t.Errorf("expected UnmarshalError but got %T", err)
+	}
+}
+
+func TestUnmarshalErrorUnwrap(t *testing.T) {
+	reg := Registry()
+	reg.Add("int", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, n int) {}, "", nil))
+	reg.Add("float", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, f float64) {}, "", nil))
+
+	s := testSession()
+	err := reg.Exec(s, testMessage(""), "int", "abc")
+	var numErr *strconv.NumError
+	if !errors.As(err, &numErr) || numErr.Num != "abc" {
+		t.Errorf("expected a *strconv.NumError in %v", err)
+	}
+	err = reg.Exec(s, testMessage(""), "float", "abc")
+	var jsonErr *json.SyntaxError
+	if !errors.As(err, &jsonErr) {
+		t.Errorf("expected a *json.SyntaxError in %v", err)
+	}
+}
+
+func TestArgParseError(t *testing.T) {
+	reg := Registry()
+	reg.Add("ban", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, who string, days int, reason []string) {
+	}, "", nil))
+	reg.Add("scale", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, factors []float64) {
+	}, "", nil))
+
+	s := testSession()
+	cases := []struct {
+		name   string
+		args   []string
+		expect ArgParseError
+	}{
+		{"ban", []string{"someone", "abc", "spam"}, ArgParseError{Command: "ban", ArgIndex: 1, Raw: "abc"}},
+		{"scale", []string{"1", "2.5", "x"}, ArgParseError{Command: "scale", ArgIndex: 2, Raw: "x"}},
+	}
+	for _, c := range cases {
+		err := reg.Exec(s, testMessage(""), c.name, c.args...)
+		var perr ArgParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("%s: expected ArgParseError but got %v", c.name, err)
+			continue
+		}
+		if !errors.As(perr.Err, &UnmarshalError{}) {
+			t.Errorf("%s: expected ArgParseError to wrap an UnmarshalError, got %v", c.name, perr.Err)
+		}
+		perr.Err = nil
+		if perr != c.expect {
+			t.Errorf("%s: expected %+v but got %+v", c.name, c.expect, perr)
+		}
+	}
+}
+
+func TestNilSession(t *testing.T) {
+	for _, ttype := range []reflect.Type{userType, channelType, roleType, memberType} {
+		_, err := tryConvert(nil, testMessage(""), ttype, "<@1234>")
+		var uerr UnmarshalError
+		if !errors.As(err, &uerr) || !strings.Contains(uerr.Why.Error(), "session required") {
+			t.Errorf("%s: expected a session to be required, got %v", ttype, err)
+		}
+	}
+	if val, err := tryConvert(nil, nil, reflect.TypeOf(0), "42"); err != nil || val.Interface() != 42 {
+		t.Errorf("expected scalars to convert without a session, got (%v, %v)", val, err)
+	}
+
+	cmd := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, who *discordgo.User) {}, "", nil)
+	if err := cmd.Invoke(nil, testMessage(""), []string{"<@1234>"}); !errors.As(err, &UnmarshalError{}) {
+		t.Errorf("expected UnmarshalError but got %v", err)
+	}
+
+	reg := Registry()
+	reg.Converters = map[reflect.Type]CmdConverter{
+		userType: func(s *discordgo.Session, m *discordgo.MessageCreate, str string) (interface{}, error) {
+			return s.User(str)
+		},
+	}
+	if _, err := reg.convert(nil, nil, userType, "1234"); err == nil || !strings.Contains(err.Error(), "session required") {
+		t.Errorf("expected a session to be required, got %v", err)
+	}
+}
+
+func TestGlobalPredicate(t *testing.T) {
+	s := testSession()
+	maintenance := true
+	ran := 0
+	reg := Registry()
+	reg.GlobalPredicate.Custom = func(s *discordgo.Session, m *discordgo.MessageCreate, p CmdPredicate) bool {
+		return !maintenance
+	}
+	reg.Add("ping", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) { ran++ }, "", nil))
+
+	var reported []error
+	handler := func(s *discordgo.Session, m *discordgo.MessageCreate, err error) {
+		reported = append(reported, err)
+	}
+	for _, content := range []string{"!ping", "!bogus", "hello"} {
+		reg.Handle(s, testMessage(content), "!", handler)
+	}
+	if ran != 0 || len(reported) != 2 || !errors.Is(reported[0], AccessDenied{}) || !errors.Is(reported[1], AccessDenied{}) {
+		t.Errorf("expected commands to be denied during maintenance, ran %d times and got %v", ran, reported)
+	}
+
+	if err := reg.Exec(s, testMessage(""), "ping"); err != (AccessDenied{}) || ran != 0 {
+		t.Errorf("expected Exec to be denied during maintenance, got %v", err)
+	}
+
+	maintenance = false
+	reg.Handle(s, testMessage("!ping"), "!", handler)
+	if ran != 1 || len(reported) != 2 {
+		t.Errorf("expected command to run after maintenance, ran %d times and got %v", ran, reported)
+	}
+}
+
+func TestScope(t *testing.T) {
+	s := testSession() /* no REST client, so any API call fails the test */
+	ran := map[string]int{}
+	reg := Registry()
+	for name, scope := range map[string]CmdScope{"guild": GuildOnly, "dm": DMOnly, "any": AnyScope} {
+		name := name
+		reg.Add(name, MustPredicatedCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+			ran[name]++
+		}, "", nil, CmdPredicate{Scope: scope}))
+	}
+
+	cases := []struct {
+		name, guild string
+		err         error
+	}{
+		{"guild", "", WrongContext{"in a server"}},
+		{"guild", "guild", nil},
+		{"dm", "guild", WrongContext{"in direct messages"}},
+		{"dm", "", nil},
+		{"any", "", nil},
+		{"any", "guild", nil},
+	}
+	for _, c := range cases {
+		m := testMessage("!" + c.name)
+		m.GuildID = c.guild
+		if _, _, err := reg.Dispatch(s, m, "!"); err != c.err {
+			t.Errorf("%s in guild %q: expected %v but got %v", c.name, c.guild, c.err, err)
+		}
+	}
+	if expect := map[string]int{"guild": 1, "dm": 1, "any": 2}; !reflect.DeepEqual(ran, expect) {
+		t.Errorf("expected commands to run %v times, got %v", expect, ran)
+	}
+}
+
+func TestIntegerRanges(t *testing.T) {
+	cases := []struct {
+		ttype    reflect.Type
+		min, max string
+		expect   string
+	}{
+		{reflect.TypeOf(int8(0)), "-128", "127", "from -128 to 127"},
+		{reflect.TypeOf(uint8(0)), "0", "255", "from 0 to 255"},
+		{reflect.TypeOf(int16(0)), "-32768", "32767", "from -32768 to 32767"},
+		{reflect.TypeOf(uint16(0)), "0", "65535", "from 0 to 65535"},
+		{reflect.TypeOf(int32(0)), "-2147483648", "2147483647", "from -2147483648 to 2147483647"},
+		{reflect.TypeOf(uint64(0)), "0", "18446744073709551615", "from 0 to 18446744073709551615"},
+	}
+	outside := func(n string, delta int64) string {
+		b, _ := new(big.Int).SetString(n, 10)
+		return b.Add(b, big.NewInt(delta)).String()
+	}
+	for _, c := range cases {
+		for _, str := range []string{c.min, c.max} {
+			if _, err := tryConvert(nil, nil, c.ttype, str); err != nil {
+				t.Errorf("%s as %s: unexpected error %v", str, c.ttype, err)
+			}
+		}
+		for _, str := range []string{outside(c.min, -1), outside(c.max, 1)} {
+			_, err := tryConvert(nil, nil, c.ttype, str)
+			var uerr UnmarshalError
+			if !errors.As(err, &uerr) || !strings.Contains(uerr.Why.Error(), c.expect) {
+				t.Errorf("%s as %s: expected UnmarshalError naming range %q, got %v", str, c.ttype, c.expect, err)
+			}
+			if !errors.Is(err, strconv.ErrRange) {
+				t.Errorf("%s as %s: expected strconv.ErrRange to be wrapped", str, c.ttype)
+			}
+		}
+	}
+}
+
+type testObserver struct {
+	ids   []RequestID
+	names []string
+	errs  []error
+}
+
+func (o *testObserver) OnInvoke(id RequestID, name string, dur time.Duration, err error) {
+	o.ids = append(o.ids, id)
+	o.names = append(o.names, name)
+	o.errs = append(o.errs, err)
+}
+
+func TestObserver(t *testing.T) {
+	s := testSession()
+	failure := errors.New("out of coffee")
+	obs := &testObserver{}
+	reg := Registry()
+	reg.Observer = obs
+	reg.Add("ping", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {}, "", nil))
+	reg.Add("brew", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) error {
+		return failure
+	}, "", nil))
+	reg.Alias("p", "ping")
+
+	for _, content := range []string{"!p", "!brew", "!bogus", "hello"} {
+		reg.Handle(s, testMessage(content), "!", nil)
+	}
+	if expect := []string{"ping", "brew"}; !reflect.DeepEqual(obs.names, expect) {
+		t.Errorf("expected %v to be observed, got %v", expect, obs.names)
+	}
+	if expect := []error{nil, failure}; !reflect.DeepEqual(obs.errs, expect) {
+		t.Errorf("expected outcomes %v, got %v", expect, obs.errs)
+	}
+	if len(obs.ids) != 2 || obs.ids[0] == "" || obs.ids[0] == obs.ids[1] {
+		t.Errorf("expected each invocation to have its own request ID, got %q", obs.ids)
+	}
+}
+
+func TestLogf(t *testing.T) {
+	s := testSession()
+	var lines []string
+	reg := Registry()
+	reg.Logf = func(level, format string, args ...interface{}) {
+		lines = append(lines, level+": "+fmt.Sprintf(format, args...))
+	}
+	reg.Add("kick", MustPredicatedCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+	}, "", nil, CmdPredicate{Custom: func(s *discordgo.Session, m *discordgo.MessageCreate, p CmdPredicate) bool {
+		return false
+	}}))
+
+	reg.Handle(s, testMessage("hello"), "!", nil)
+	if len(lines) != 0 {
+		t.Errorf("expected plain messages not to be logged, got %q", lines)
+	}
+	m := testMessage("!kick")
+	m.ID = "1234"
+	reg.Handle(s, m, "!", nil)
+	expect := []string{
+		`debug: message 1234 by user matched prefix "!"`,
+		"debug: message 1234 by user resolved to kick",
+		"info: kick by user denied: access denied",
+	}
+	/* Lines about the same message share a request ID */
+	var id string
+	if len(lines) > 0 {
+		fmt.Sscanf(lines[0], "debug: [%16s]", &id)
+	}
+	for c, line := range expect {
+		level := strings.SplitN(line, " ", 2)
+		expect[c] = fmt.Sprintf("%s [%s] %s", level[0], id, level[1])
+	}
+	if !reflect.DeepEqual(lines, expect) {
+		t.Errorf("expected %q but got %q", expect, lines)
+	}
+
+	reg.Logf = nil
+	reg.Handle(s, testMessage("!kick"), "!", nil)
+	if len(lines) != len(expect) {
+		t.Errorf("expected nothing to be logged without Logf")
+	}
+}
+
+func TestRequestError(t *testing.T) {
+	s := testSession()
+	failure := errors.New("out of coffee")
+	obs := &testObserver{}
+	reg := Registry()
+	reg.Observer = obs
+	reg.Add("brew", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) error {
+		return failure
+	}, "", nil))
+
+	var handled error
+	reg.Handle(s, testMessage("!brew"), "!", func(s *discordgo.Session, m *discordgo.MessageCreate, err error) {
+		handled = err
+	})
+	var reqErr RequestError
+	if !errors.As(handled, &reqErr) || !errors.Is(handled, failure) {
+		t.Fatalf("expected a RequestError wrapping %v, got %v", failure, handled)
+	}
+	if len(obs.ids) != 1 || reqErr.RequestID() != obs.ids[0] {
+		t.Errorf("expected error handler to get request ID %v, got %q", obs.ids, reqErr.RequestID())
+	}
+}
+
+func TestRestOfLine(t *testing.T) {
+	var got []string
+	echo := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, times int, text string) {
+		for c := 0; c < times; c++ {
+			got = append(got, text)
+		}
+	}, "", nil)
+	if err := echo.RestOfLine(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if usage := echo.Usage("echo"); usage != "echo <number> <text...>" {
+		t.Errorf("unexpected usage %q", usage)
+	}
+
+	s := testSession()
+	reg := Registry()
+	reg.Add("echo", echo)
+	if _, _, err := reg.Dispatch(s, testMessage("!echo 2 the rest of this line"), "!"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expect := []string{"the rest of this line", "the rest of this line"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected %q but got %q", expect, got)
+	}
+	for content, expect := range map[string]string{
+		`!echo 1 he said "hi   there" don't`: `he said "hi   there" don't`,
+		`!echo 1 a\ b  \"c`:                  `a\ b  \"c`,
+	} {
+		got = nil
+		if _, _, err := reg.Dispatch(s, testMessage(content), "!"); err != nil {
+			t.Errorf("%q: unexpected error: %s", content, err)
+		} else if len(got) == 0 || got[len(got)-1] != expect {
+			t.Errorf("%q: expected %q but got %q", content, expect, got)
+		}
+	}
+	if _, _, err := reg.Dispatch(s, testMessage("!echo 2"), "!"); err != (ArgCountMismatch{2, 1}) {
+		t.Errorf("expected ArgCountMismatch but got %v", err)
+	}
+
+	var gotLoud bool
+	var gotText string
+	shout := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, loud bool, text string) {
+		gotLoud, gotText = loud, text
+	}, "", nil)
+	if err := shout.Shorthand(0, 'l'); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := shout.RestOfLine(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	reg.Add("shout", shout)
+	if _, _, err := reg.Dispatch(s, testMessage("!shout  up   here -l"), "!"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if !gotLoud || gotText != "up   here" {
+		t.Errorf("expected (true, %q) but got (%v, %q)", "up   here", gotLoud, gotText)
+	}
+
+	for _, fn := range []interface{}{
+		func(s *discordgo.Session, m *discordgo.MessageCreate, text string, n int) {},
+		func(s *discordgo.Session, m *discordgo.MessageCreate, words []string) {},
+		func(s *discordgo.Session, m *discordgo.MessageCreate) {},
+	} {
+		if err := MustCommand(fn, "", nil).RestOfLine(); err == nil {
+			t.Errorf("%T: expected an error", fn)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package dgutils
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+//
+// Limits how often each user may run a command, see CmdPredicate.Cooldown. Interval
+// is the minimum time between invocations by the same user.
+// Members having any of BypassRoles, or any of the BypassPermissions (checked the
+// same way as CmdPredicate.Permissions), aren't limited, so staff can be exempt from
+// cooldowns on commands meant to be throttled for everyone else.
+// PerChannel and PerGuild keep track of invocations in each channel or guild apart,
+// so users may run the command again right away somewhere else. In direct messages,
+// PerGuild behaves as PerChannel.
+// Invocations are forgotten once their interval is over, so the cooldown doesn't
+// grow with every user who ever ran the command.
+//
+type CmdCooldown struct {
+	Interval          time.Duration
+	BypassRoles       []string
+	BypassPermissions int
+	PerChannel        bool
+	PerGuild          bool
+	lock              sync.Mutex
+	last              map[string]time.Time /* see key -> last invocation */
+	nextSweep         time.Time            /* when to forget expired invocations */
+}
+
+//
+// Creates a cooldown with interval as the minimum time between invocations
+//
+func Cooldown(interval time.Duration) *CmdCooldown {
+	return &CmdCooldown{Interval: interval, last: map[string]time.Time{}}
+}
+
+//
+// Returns OnCooldown if the author of m ran the command less than Interval ago,
+// otherwise records the invocation. BypassPermissions are checked with resolve
+//
+func (cd *CmdCooldown) check(resolve CmdPermissionResolver, s *discordgo.Session, m *discordgo.MessageCreate) error {
+	if cd.bypass(resolve, s, m) {
+		return nil
+	}
+	cd.lock.Lock()
+	defer cd.lock.Unlock()
+	now := time.Now()
+	key := cd.key(m)
+	if remaining := cd.last[key].Add(cd.Interval).Sub(now); remaining > 0 {
+		return OnCooldown{remaining}
+	}
+	if cd.last == nil {
+		cd.last = map[string]time.Time{}
+	}
+	cd.sweep(now)
+	cd.last[key] = now
+	return nil
+}
+
+//
+// Identifies who the invocation m counts towards
+//
+func (cd *CmdCooldown) key(m *discordgo.MessageCreate) string {
+	switch {
+	case cd.PerChannel || (cd.PerGuild && m.GuildID == ""):
+		return m.Author.ID + ":" + m.ChannelID
+	case cd.PerGuild:
+		return m.Author.ID + ":" + m.GuildID
+	}
+	return m.Author.ID
+}
+
+//
+// Forgets invocations older than Interval, at most once every Interval
+//
+func (cd *CmdCooldown) sweep(now time.Time) {
+	if now.Before(cd.nextSweep) {
+		return
+	}
+	for key, last := range cd.last {
+		if now.Sub(last) >= cd.Interval {
+			delete(cd.last, key)
+		}
+	}
+	cd.nextSweep = now.Add(cd.Interval)
+}
+
+//
+// Returns how long until the author of m may run the command again, without
+// recording an invocation
+//
+func (cd *CmdCooldown) remaining(
+	resolve CmdPermissionResolver,
+	s *discordgo.Session,
+	m *discordgo.MessageCreate,
+) time.Duration {
+	if cd.bypass(resolve, s, m) {
+		return 0
+	}
+	cd.lock.Lock()
+	defer cd.lock.Unlock()
+	return cd.last[cd.key(m)].Add(cd.Interval).Sub(time.Now())
+}
+
+//
+// Whether the author of m isn't limited, BypassPermissions being checked with resolve
+//
+func (cd *CmdCooldown) bypass(resolve CmdPermissionResolver, s *discordgo.Session, m *discordgo.MessageCreate) bool {
+	if m.GuildID == "" || (len(cd.BypassRoles) == 0 && cd.BypassPermissions == 0) {
+		return false
+	}
+	if cd.BypassPermissions != 0 {
+		if perm, _ := resolve(s, m, cd.BypassPermissions); perm {
+			return true
+		}
+	}
+	member, err := s.State.Member(m.GuildID, m.Author.ID)
+	if err != nil {
+		if member, err = s.GuildMember(m.GuildID, m.Author.ID); err != nil {
+			return false
+		}
+	}
+	for _, role := range member.Roles {
+		for _, bypass := range cd.BypassRoles {
+			if role == bypass {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package dgutils
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestCooldown(t *testing.T) {
+	s := testSession()
+	s.State.GuildAdd(&discordgo.Guild{
+		ID: "guild",
+		Members: []*discordgo.Member{
+			{User: &discordgo.User{ID: "user"}, GuildID: "guild"},
+			{User: &discordgo.User{ID: "mod"}, GuildID: "guild", Roles: []string{"staff"}},
+		},
+	})
+	pred := CmdPredicate{Cooldown: Cooldown(time.Hour)}
+	pred.Cooldown.BypassRoles = []string{"staff"}
+
+	user, mod := testMessage(""), testMessage("")
+	user.GuildID, mod.GuildID = "guild", "guild"
+	mod.Author.ID = "mod"
+
+	if err := pred.Check(s, user); err != nil {
+		t.Fatalf("unexpected error on first invocation: %s", err)
+	}
+	if err, ok := pred.Check(s, user).(OnCooldown); !ok || err.Remaining <= 0 || err.Remaining > time.Hour {
+		t.Errorf("expected OnCooldown on second invocation but got %v", err)
+	}
+	for c := 0; c < 2; c++ {
+		if err := pred.Check(s, mod); err != nil {
+			t.Errorf("member with bypass role got throttled: %s", err)
+		}
+	}
+}
+
+func TestCooldownScopes(t *testing.T) {
+	s := testSession()
+	msg := func(guild, channel string) *discordgo.MessageCreate {
+		m := testMessage("")
+		m.GuildID, m.ChannelID = guild, channel
+		return m
+	}
+	for i, c := range []struct {
+		cd      *CmdCooldown
+		limited []*discordgo.MessageCreate
+		free    []*discordgo.MessageCreate
+	}{
+		{
+			cd:      &CmdCooldown{Interval: time.Hour, PerChannel: true},
+			limited: []*discordgo.MessageCreate{msg("guild", "a")},
+			free:    []*discordgo.MessageCreate{msg("guild", "b"), msg("", "dm")},
+		},
+		{
+			cd:      &CmdCooldown{Interval: time.Hour, PerGuild: true},
+			limited: []*discordgo.MessageCreate{msg("guild", "a"), msg("guild", "b")},
+			free:    []*discordgo.MessageCreate{msg("other", "c"), msg("", "dm")},
+		},
+		{
+			cd:      Cooldown(time.Hour),
+			limited: []*discordgo.MessageCreate{msg("guild", "a"), msg("other", "c"), msg("", "dm")},
+		},
+	} {
+		if err := c.cd.check(memberPermissions, s, msg("guild", "a")); err != nil {
+			t.Fatalf("unexpected error on first invocation: %s", err)
+		}
+		for _, m := range c.limited {
+			if _, ok := c.cd.check(memberPermissions, s, m).(OnCooldown); !ok {
+				t.Errorf("case %d: expected invocation in %s/%s to be limited", i, m.GuildID, m.ChannelID)
+			}
+		}
+		for _, m := range c.free {
+			if err := c.cd.check(memberPermissions, s, m); err != nil {
+				t.Errorf("case %d: unexpected error in %s/%s: %s", i, m.GuildID, m.ChannelID, err)
+			}
+		}
+	}
+
+	cd := Cooldown(10 * time.Millisecond)
+	for _, user := range []string{"a", "b", "c"} {
+		m := testMessage("")
+		m.Author.ID = user
+		cd.check(memberPermissions, s, m)
+	}
+	time.Sleep(20 * time.Millisecond)
+	cd.check(memberPermissions, s, testMessage(""))
+	if len(cd.last) != 1 {
+		t.Errorf("expected expired invocations to be forgotten, got %v", cd.last)
+	}
+}
+
+func TestCooldownBadArguments(t *testing.T) {
+	s := testSession()
+	noop := func(s *discordgo.Session, m *discordgo.MessageCreate, sides int) {}
+	reg := Registry()
+	reg.Add("roll", MustPredicatedCommand(noop, "", nil, CmdPredicate{Cooldown: Cooldown(time.Hour)}))
+	reg.Add("flip", WithCooldown(MustCommand(noop, "", nil), time.Hour))
+
+	for _, name := range []string{"roll", "flip"} {
+		if _, _, err := reg.Dispatch(s, testMessage("!"+name), "!"); err != (ArgCountMismatch{1, 0}) {
+			t.Errorf("%s: expected ArgCountMismatch but got %v", name, err)
+		}
+		if _, _, err := reg.Dispatch(s, testMessage("!"+name+" six"), "!"); err == nil {
+			t.Errorf("%s: expected conversion error", name)
+		}
+		if _, _, err := reg.Dispatch(s, testMessage("!"+name+" 6"), "!"); err != nil {
+			t.Errorf("%s: invocations with bad arguments counted towards the cooldown: %s", name, err)
+		}
+		if _, _, err := reg.Dispatch(s, testMessage("!"+name+" 6"), "!"); !errors.As(err, &OnCooldown{}) {
+			t.Errorf("%s: expected OnCooldown but got %v", name, err)
+		}
+	}
+}
+
+func TestCooldownBypassResolver(t *testing.T) {
+	s := testSession()
+	reg := Registry()
+	cd := Cooldown(time.Hour)
+	cd.BypassPermissions = discordgo.PermissionManageMessages
+	reg.Add("daily", MustPredicatedCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+	}, "", nil, CmdPredicate{Cooldown: cd}))
+	reg.SetPermissionResolver(func(s *discordgo.Session, m *discordgo.MessageCreate, required int) (bool, error) {
+		return m.Author.ID == "staff", nil
+	})
+
+	m := testMessage("!daily")
+	m.GuildID, m.Author.ID = "guild", "staff"
+	for c := 0; c < 2; c++ {
+		if _, _, err := reg.Dispatch(s, m, "!"); err != nil {
+			t.Errorf("member with bypass permissions got throttled: %s", err)
+		}
+	}
+}
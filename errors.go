@@ -1,7 +1,14 @@
 package dgutils
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
 )
 
 /*
@@ -24,14 +31,270 @@ func (e AccessDenied) Error() string {
 	return "access denied"
 }
 
+//
+// User ran a command again before its cooldown expired
+//
+type OnCooldown struct {
+	Remaining time.Duration
+}
+
+func (e OnCooldown) Error() string {
+	return fmt.Sprintf("command is on cooldown, try again in %s", e.Remaining.Round(time.Second))
+}
+
+//
+// User invoked an Exclusive command while their previous invocation is running
+//
+type AlreadyRunning struct{}
+
+func (e AlreadyRunning) Error() string {
+	return "command is already running, wait for it to finish"
+}
+
+//
+// There's no command named Name in the register
+//
+type NoSuchCommand struct {
+	Name string
+}
+
+func (e NoSuchCommand) Error() string {
+	return "no such command " + e.Name
+}
+
+//
+// Command grouping subcommands (see CmdRegistry.Invoke) was invoked without one.
+// Subcommands lists the available ones
+//
+type MissingSubcommand struct {
+	Name        string
+	Subcommands []string
+}
+
+func (e MissingSubcommand) Error() string {
+	return fmt.Sprintf("%s needs a subcommand, one of: %s", e.Name, strings.Join(e.Subcommands, ", "))
+}
+
+//
+// Command was used in a channel it isn't meant for. Where describes where it should
+// have been used instead
+//
+type WrongContext struct {
+	Where string
+}
+
+func (e WrongContext) Error() string {
+	return "command can only be used " + e.Where
+}
+
+//
+// Message exceeds the register's MaxContentLength
+//
+type ContentTooLong struct {
+	Limit, Got int
+}
+
+func (e ContentTooLong) Error() string {
+	return fmt.Sprintf("message is %d bytes long, limit is %d", e.Got, e.Limit)
+}
+
+//
+// Message has more commands piped together than the register's MaxPipeline
+//
+type PipelineTooLong struct {
+	Limit, Got int
+}
+
+func (e PipelineTooLong) Error() string {
+	return fmt.Sprintf("pipeline has %d commands, limit is %d", e.Got, e.Limit)
+}
+
+//
+// Argument for the parameter at index Param is longer than the Limit set with
+// FnCmd.MaxLength, both in runes
+//
+type ArgTooLong struct {
+	Param, Limit, Got int
+}
+
+func (e ArgTooLong) Error() string {
+	return fmt.Sprintf("argument %d is too long, got %d characters out of %d", e.Param+1, e.Got, e.Limit)
+}
+
 //
 // Argument parser failure
-// Why (probably) has more information about what actually happened
+// Why (probably) has more information about what actually happened, and is what
+// Unwrap returns, so errors.Is and errors.As can look into it
+// Transient is set if the argument may well be valid, but looking it up failed
+// because of a network error, or Discord being unavailable or rate limiting us,
+// so that error handlers can tell retrying apart from asking for valid input.
 //
 type UnmarshalError struct {
-	Why error /* underlying error */
+	Why       error /* underlying error */
+	Transient bool  /* whether looking something up failed for reasons other than bad input */
 }
 
 func (e UnmarshalError) Error() string {
 	return fmt.Sprintf("cannot unmarshal arguments: %s", e.Why)
 }
+
+func (e UnmarshalError) Unwrap() error {
+	return e.Why
+}
+
+//
+// Argument at index ArgIndex (counting from the first argument after the command's
+// name, and after flags are taken out) of an invocation of Command couldn't be
+// parsed; Raw is the argument as given, and Err, usually an UnmarshalError, is why.
+// Command is empty if the command wasn't invoked through a register
+//
+type ArgParseError struct {
+	Command  string
+	ArgIndex int
+	Raw      string
+	Err      error
+}
+
+func (e ArgParseError) Error() string {
+	if e.Command == "" {
+		return fmt.Sprintf("argument #%d (%q): %v", e.ArgIndex+1, e.Raw, e.Err)
+	}
+	return fmt.Sprintf("argument #%d (%q) to %s: %v", e.ArgIndex+1, e.Raw, e.Command, e.Err)
+}
+
+func (e ArgParseError) Unwrap() error {
+	return e.Err
+}
+
+//
+// Several errors reported as one, such as every invalid element of a slice argument
+// (see FnCmd.AggregateErrors). Works like errors.Join from Go 1.20, which we can't
+// depend on just yet
+//
+type joinedError []error
+
+func (e joinedError) Error() string {
+	msgs := make([]string, len(e))
+	for c, err := range e {
+		msgs[c] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e joinedError) Unwrap() []error {
+	return e
+}
+
+//
+// Commands or aliases of a register being merged with CmdRegistry.Merge that are
+// already in the register
+//
+type MergeConflict struct {
+	Names []string
+}
+
+func (e MergeConflict) Error() string {
+	return "already in register: " + strings.Join(e.Names, ", ")
+}
+
+//
+// Role name given as an argument matches more than one role
+//
+type AmbiguousRole struct {
+	Query      string
+	Candidates []string /* names of matching roles */
+}
+
+func (e AmbiguousRole) Error() string {
+	return fmt.Sprintf("role '%s' is ambiguous, could be any of: %s", e.Query, strings.Join(e.Candidates, ", "))
+}
+
+//
+// No target could be found by ResolveTarget
+//
+type NoTarget struct{}
+
+func (e NoTarget) Error() string {
+	return "no target given, reply to their message, mention them or give their ID"
+}
+
+//
+// Error with a message meant for users, as opposed to the error itself which is
+// meant for logs. Public is shown instead of the error by ReplyError; Err, if set,
+// is what Error and Unwrap report, so internal details stay out of the channel.
+//
+type UserFacing struct {
+	Public string
+	Err    error
+}
+
+//
+// Creates a UserFacing error with a formatted public message and no internal error
+//
+func Userf(format string, args ...interface{}) UserFacing {
+	return UserFacing{Public: fmt.Sprintf(format, args...)}
+}
+
+func (e UserFacing) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return e.Public
+}
+
+func (e UserFacing) Unwrap() error {
+	return e.Err
+}
+
+//
+// Error of a command invoked through a register, as handed to error handlers (see
+// CmdErrorHandler), carrying the request ID the invocation was logged with (see
+// RequestID), so that the handler's own logs can be matched with Logf's
+//
+type RequestError struct {
+	ID  RequestID
+	Err error
+}
+
+func (e RequestError) Error() string {
+	return e.Err.Error()
+}
+
+func (e RequestError) Unwrap() error {
+	return e.Err
+}
+
+func (e RequestError) RequestID() RequestID {
+	return e.ID
+}
+
+//
+// Finds the public message of a UserFacing error in err's chain
+//
+func publicMessage(err error) (string, bool) {
+	for err != nil {
+		switch e := err.(type) {
+		case UserFacing:
+			return e.Public, true
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return "", false
+		}
+	}
+	return "", false
+}
+
+//
+// Whether err is a network error, or a response from Discord suggesting that the
+// same request could succeed later
+//
+func isTransient(err error) bool {
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) {
+		status := restErr.Response.StatusCode
+		return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
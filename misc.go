@@ -1,6 +1,13 @@
 package dgutils
 
 import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
 	"github.com/bwmarrin/discordgo"
 )
 
@@ -11,37 +18,675 @@ import (
 
 //
 // Checks if a given member with ID userID has permissions permission on guild
-// with ID guildID
+// with ID guildID. Nobody has permissions outside of a guild, so it's always false
+// if guildID is empty
 //
 func MemberHasPermissions(s *discordgo.Session, guildID, userID string, permission int) (bool, error) {
-	member, err := s.State.Member(guildID, userID)
+	if guildID == "" {
+		return false, nil
+	}
+	perms, err := MemberPermissions(s, guildID, userID)
 	if err != nil {
-		if member, err = s.GuildMember(guildID, userID); err != nil {
-			return false, err
-		}
+		return false, err
 	}
+	return perms&permission != 0, nil
+}
 
-	for _, roleID := range member.Roles {
+//
+// Returns the guild-wide permissions of member with ID userID on guild with ID
+// guildID, combining those of their roles and of @everyone, which applies to every
+// member without being listed among their roles. Administrators and the guild's
+// owner have every permission, as Discord grants them regardless of the others
+//
+func MemberPermissions(s *discordgo.Session, guildID, userID string) (int, error) {
+	member, err := stateMember(s, guildID, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	perms := 0
+	/* @everyone's ID is the same as the guild's */
+	for _, roleID := range append([]string{guildID}, member.Roles...) {
 		role, err := s.State.Role(guildID, roleID)
 		if err != nil {
-			return false, err
+			return 0, err
+		}
+		perms |= role.Permissions
+	}
+	if perms&discordgo.PermissionAdministrator != 0 {
+		return discordgo.PermissionAll, nil
+	}
+	if owner, _ := IsOwner(s, guildID, userID); owner {
+		return discordgo.PermissionAll, nil
+	}
+
+	return perms, nil
+}
+
+//
+// Same as MemberHasPermissions, but takes into account the permission overwrites of
+// channel with ID channelID, as MemberChannelPermissions does
+//
+func MemberHasChannelPermissions(s *discordgo.Session, guildID, channelID, userID string, permission int) (bool, error) {
+	if guildID == "" {
+		return false, nil
+	}
+	perms, err := MemberChannelPermissions(s, guildID, channelID, userID)
+	if err != nil {
+		return false, err
+	}
+	return perms&permission != 0, nil
+}
+
+//
+// Returns the permissions of member with ID userID on channel with ID channelID of
+// guild with ID guildID; that is, their guild-wide permissions with the channel's
+// overwrites for @everyone, their roles and themselves applied, in that order.
+// Threads use the overwrites of their parent channel. Administrators and the guild's
+// owner aren't affected by overwrites
+//
+func MemberChannelPermissions(s *discordgo.Session, guildID, channelID, userID string) (int, error) {
+	perms, err := MemberPermissions(s, guildID, userID)
+	if err != nil || perms&discordgo.PermissionAdministrator != 0 {
+		return perms, err
+	}
+	channel, err := stateChannel(s, channelID)
+	if err != nil {
+		return 0, err
+	}
+	if isThread(channel.Type) {
+		if channel, err = stateChannel(s, channel.ParentID); err != nil {
+			return 0, err
+		}
+	}
+	member, err := stateMember(s, guildID, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	roles := make(map[string]bool, len(member.Roles))
+	for _, roleID := range member.Roles {
+		roles[roleID] = true
+	}
+	var everyone, role, user struct{ allow, deny int }
+	for _, o := range channel.PermissionOverwrites {
+		switch {
+		case o.ID == guildID:
+			everyone.allow, everyone.deny = o.Allow, o.Deny
+		case o.Type == "member" && o.ID == userID:
+			user.allow, user.deny = o.Allow, o.Deny
+		case o.Type != "member" && roles[o.ID]:
+			role.allow |= o.Allow
+			role.deny |= o.Deny
 		}
-		if role.Permissions&permission != 0 {
-			return true, nil
+	}
+	for _, o := range [...]struct{ allow, deny int }{everyone, role, user} {
+		perms = perms&^o.deny | o.allow
+	}
+	return perms, nil
+}
+
+//
+// Looks up member with ID userID of guild with ID guildID, from state if possible
+//
+func stateMember(s *discordgo.Session, guildID, userID string) (*discordgo.Member, error) {
+	if member, err := s.State.Member(guildID, userID); err == nil {
+		return member, nil
+	}
+	return s.GuildMember(guildID, userID)
+}
+
+/* Names of permissions as shown in Discord, in the order PermissionNames lists them */
+var permissionNames = []struct {
+	bit  int
+	name string
+}{
+	{discordgo.PermissionAdministrator, "Administrator"},
+	{discordgo.PermissionViewAuditLogs, "View Audit Log"},
+	{discordgo.PermissionManageServer, "Manage Server"},
+	{discordgo.PermissionManageRoles, "Manage Roles"},
+	{discordgo.PermissionManageChannels, "Manage Channels"},
+	{discordgo.PermissionKickMembers, "Kick Members"},
+	{discordgo.PermissionBanMembers, "Ban Members"},
+	{discordgo.PermissionCreateInstantInvite, "Create Invite"},
+	{discordgo.PermissionChangeNickname, "Change Nickname"},
+	{discordgo.PermissionManageNicknames, "Manage Nicknames"},
+	{discordgo.PermissionManageEmojis, "Manage Emojis"},
+	{discordgo.PermissionManageWebhooks, "Manage Webhooks"},
+	{discordgo.PermissionViewChannel, "View Channels"},
+	{discordgo.PermissionSendMessages, "Send Messages"},
+	{discordgo.PermissionSendTTSMessages, "Send TTS Messages"},
+	{discordgo.PermissionManageMessages, "Manage Messages"},
+	{discordgo.PermissionEmbedLinks, "Embed Links"},
+	{discordgo.PermissionAttachFiles, "Attach Files"},
+	{discordgo.PermissionReadMessageHistory, "Read Message History"},
+	{discordgo.PermissionMentionEveryone, "Mention Everyone"},
+	{discordgo.PermissionUseExternalEmojis, "Use External Emojis"},
+	{discordgo.PermissionAddReactions, "Add Reactions"},
+	{discordgo.PermissionVoiceConnect, "Connect"},
+	{discordgo.PermissionVoiceSpeak, "Speak"},
+	{discordgo.PermissionVoiceMuteMembers, "Mute Members"},
+	{discordgo.PermissionVoiceDeafenMembers, "Deafen Members"},
+	{discordgo.PermissionVoiceMoveMembers, "Move Members"},
+	{discordgo.PermissionVoiceUseVAD, "Use Voice Activity"},
+	{discordgo.PermissionVoicePrioritySpeaker, "Priority Speaker"},
+}
+
+//
+// Returns the names of the permissions set in perms, as shown in Discord
+//
+func PermissionNames(perms int) (names []string) {
+	for _, perm := range permissionNames {
+		if perms&perm.bit != 0 {
+			names = append(names, perm.name)
 		}
 	}
+	return
+}
 
-	return false, nil
+/* Thread and forum channel types, which our version of discordgo doesn't know about */
+const (
+	channelTypeGuildNewsThread    discordgo.ChannelType = 10
+	channelTypeGuildPublicThread  discordgo.ChannelType = 11
+	channelTypeGuildPrivateThread discordgo.ChannelType = 12
+	channelTypeGuildForum         discordgo.ChannelType = 15
+)
+
+func isThread(t discordgo.ChannelType) bool {
+	switch t {
+	case channelTypeGuildNewsThread, channelTypeGuildPublicThread, channelTypeGuildPrivateThread:
+		return true
+	}
+	return false
 }
 
 //
-// Checks if user with ID userID is owner of guild with ID guildID
+// Looks up channel with ID channelID, from state if possible
+//
+func stateChannel(s *discordgo.Session, channelID string) (*discordgo.Channel, error) {
+	if channel, err := s.State.Channel(channelID); err == nil {
+		return channel, nil
+	}
+	return s.Channel(channelID)
+}
+
+//
+// Looks up guild with ID guildID, from state if possible
+//
+func stateGuild(s *discordgo.Session, guildID string) (*discordgo.Guild, error) {
+	if guild, err := s.State.Guild(guildID); err == nil {
+		return guild, nil
+	}
+	return s.Guild(guildID)
+}
+
+//
+// Returns the channel system messages (such as member joins) are sent to in guild
+// with ID guildID, or nil if the guild has none
+//
+func SystemChannel(s *discordgo.Session, guildID string) (*discordgo.Channel, error) {
+	guild, err := stateGuild(s, guildID)
+	if err != nil || guild.SystemChannelID == "" {
+		return nil, err
+	}
+	return stateChannel(s, guild.SystemChannelID)
+}
+
+//
+// Returns the rules channel of guild with ID guildID, or nil if the guild has none
+//
+func RulesChannel(s *discordgo.Session, guildID string) (*discordgo.Channel, error) {
+	guild, err := stateGuild(s, guildID)
+	if err != nil || guild.RulesChannelID == "" {
+		return nil, err
+	}
+	return stateChannel(s, guild.RulesChannelID)
+}
+
+//
+// Checks if user with ID userID is owner of guild with ID guildID. It's always
+// false if guildID is empty, as in direct messages
 //
 func IsOwner(s *discordgo.Session, guildID, userID string) (bool, error) {
-	guild, err := s.Guild(guildID)
+	if guildID == "" {
+		return false, nil
+	}
+	guild, err := stateGuild(s, guildID)
 	if err != nil {
 		return false, err
 	}
 
 	return guild.OwnerID == userID, nil
 }
+
+//
+// IDs of the users operating the bot, who are trusted regardless of the guild
+// they're in; meant to be filled in at startup. See IsBotOwner
+//
+var BotOwners = map[string]bool{}
+
+//
+// Checks if user with ID userID is one of the bot's owners, as listed in
+// BotOwners. Unlike IsOwner, it doesn't depend on the guild
+//
+func IsBotOwner(userID string) bool {
+	return BotOwners[userID]
+}
+
+//
+// Fetches every role and member of guild with ID guildID into state, adding the
+// guild itself if it isn't there yet, so that commands resolving many of them don't
+// need an API call for each. Members are requested in batches of memberBatchSize;
+// discordgo already waits out rate limits between them. Nothing is cached if the
+// session has no state
+//
+func WarmGuild(s *discordgo.Session, guildID string) error {
+	if s.State == nil {
+		return discordgo.ErrNilState
+	}
+	if _, err := s.State.Guild(guildID); err != nil {
+		guild, err := s.Guild(guildID)
+		if err != nil {
+			return err
+		}
+		if err = s.State.GuildAdd(guild); err != nil {
+			return err
+		}
+	}
+
+	roles, err := s.GuildRoles(guildID)
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if err = s.State.RoleAdd(guildID, role); err != nil {
+			return err
+		}
+	}
+
+	after := ""
+	for {
+		members, err := s.GuildMembers(guildID, after, memberBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			member.GuildID = guildID
+			if err = s.State.MemberAdd(member); err != nil {
+				return err
+			}
+		}
+		if len(members) < memberBatchSize {
+			return nil
+		}
+		after = members[len(members)-1].User.ID
+	}
+}
+
+//
+// Extracts IDs from a message link, such as
+// https://discord.com/channels/81384788765712384/381887113391505410/385160066225307648
+// guildID is "@me" for messages in direct messages
+//
+func ParseMessageLink(link string) (guildID, channelID, messageID string, err error) {
+	/* Links wrapped in <> don't embed, people use it a lot */
+	link = strings.TrimSuffix(strings.TrimPrefix(link, "<"), ">")
+	u, err := url.Parse(link)
+	if err != nil {
+		return
+	}
+	switch strings.TrimPrefix(u.Host, "www.") {
+	case "discord.com", "discordapp.com", "ptb.discord.com", "canary.discord.com":
+	default:
+		err = errors.New("ParseMessageLink: not a Discord link")
+		return
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 4 || parts[0] != "channels" {
+		err = errors.New("ParseMessageLink: not a message link")
+		return
+	}
+	for c, part := range parts[1:] {
+		if (c != 0 || part != "@me") && !isSnowflake(part) {
+			err = errors.New("ParseMessageLink: malformed message link")
+			return
+		}
+	}
+	guildID, channelID, messageID = parts[1], parts[2], parts[3]
+	return
+}
+
+func isSnowflake(str string) bool {
+	if str == "" {
+		return false
+	}
+	for _, r := range str {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// Sends msg through the webhook with ID webhookID. Attachments aren't supported by
+// webhooks and are dropped
+//
+func SendViaWebhook(
+	s *discordgo.Session,
+	webhookID, token string,
+	msg *discordgo.MessageSend,
+) (*discordgo.Message, error) {
+	return s.WebhookExecute(webhookID, token, true, webhookParams(msg))
+}
+
+//
+// Sends content to channel with ID channelID as a text file named filename, for
+// output too long to be sent as a message
+//
+func SendAsFile(s *discordgo.Session, channelID, filename, content string) (*discordgo.Message, error) {
+	return s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Files: []*discordgo.File{textFile(filename, content)},
+	})
+}
+
+func textFile(name, content string) *discordgo.File {
+	return &discordgo.File{
+		Name:        name,
+		ContentType: "text/plain; charset=utf-8",
+		Reader:      strings.NewReader(content),
+	}
+}
+
+func webhookParams(msg *discordgo.MessageSend) *discordgo.WebhookParams {
+	params := &discordgo.WebhookParams{
+		Content:         msg.Content,
+		TTS:             msg.TTS,
+		AllowedMentions: msg.AllowedMentions,
+	}
+	if msg.Embed != nil {
+		params.Embeds = []*discordgo.MessageEmbed{msg.Embed}
+	}
+	return params
+}
+
+//
+// Resolves the target of a moderation-style command from, in order, the author of
+// the message m replies to, a user mentioned or given by ID as the first of args,
+// or else the first user mentioned in m other than the bot itself, so that "!warn"
+// can be used in all of those ways (including as "@Bot warn @user"). If the target
+// was given as the first argument, it's stripped off the returned arguments.
+// NoTarget is returned if there's no target to be found.
+//
+func ResolveTarget(
+	s *discordgo.Session,
+	m *discordgo.MessageCreate,
+	args []string,
+) (target *discordgo.User, rest []string, err error) {
+	if ref := m.MessageReference; ref != nil && ref.MessageID != "" {
+		channelID := ref.ChannelID
+		if channelID == "" {
+			channelID = m.ChannelID
+		}
+		msg, err := s.State.Message(channelID, ref.MessageID)
+		if err != nil {
+			if msg, err = s.ChannelMessage(channelID, ref.MessageID); err != nil {
+				return nil, args, err
+			}
+		}
+		return msg.Author, args, nil
+	}
+	if len(args) > 0 {
+		id := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(args[0], "<@"), "!"), ">")
+		if id != args[0] && isSnowflake(id) {
+			/* Mentions aren't necessarily listed in the order they appear in */
+			for _, user := range m.Mentions {
+				if user.ID == id {
+					return user, args[1:], nil
+				}
+			}
+		}
+		if isSnowflake(id) {
+			if target, err = s.User(id); err != nil {
+				return nil, args, err
+			}
+			return target, args[1:], nil
+		}
+	}
+	for _, user := range m.Mentions {
+		if s.State.User == nil || user.ID != s.State.User.ID {
+			return user, args, nil
+		}
+	}
+	return nil, args, NoTarget{}
+}
+
+/* Characters with special meaning in Discord's flavor of markdown */
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"*", `\*`,
+	"_", `\_`,
+	"~", `\~`,
+	"`", "\\`",
+	"|", `\|`,
+	">", `\>`,
+)
+
+//
+// Escapes markdown in content, so that user-supplied text is shown as typed when
+// sent back. It doesn't affect mentions; see CmdRegistry.SuppressMentions for that.
+//
+func EscapeContent(content string) string {
+	return markdownEscaper.Replace(content)
+}
+
+const (
+	maxMessageLength = 2000            /* characters in a single message */
+	maxErrorReplies  = 3               /* messages ReplyError sends before truncating */
+	typingInterval   = 8 * time.Second /* the indicator lasts for 10 seconds */
+	memberBatchSize  = 1000            /* most members the API lists at once */
+)
+
+//
+// Reports err in the channel m was sent in, formatted as a code block. Errors too
+// long for a single message are split across a few messages, and truncated after
+// that, so that reporting an error doesn't fail because of Discord's message length
+// limit. Suitable for use in error handlers.
+// If err is (or wraps) a UserFacing error, its public message is sent as is instead.
+//
+func ReplyError(s *discordgo.Session, m *discordgo.MessageCreate, err error) error {
+	const block = "```"
+	if public, ok := publicMessage(err); ok {
+		return sendChunks(s, m.ChannelID, chunkString(public, maxMessageLength), "")
+	}
+	/* Break up code fences, so the error can't end the block early */
+	text := strings.ReplaceAll(err.Error(), block, "`\u200b``")
+	chunks := chunkString(text, maxMessageLength-2*len(block)-2)
+	return sendChunks(s, m.ChannelID, chunks, block)
+}
+
+//
+// Replies to m with content, as a reply to m itself, without pinging its author.
+// If m has been deleted, content is sent as a normal message instead
+//
+func Reply(s *discordgo.Session, m *discordgo.MessageCreate, content string) (*discordgo.Message, error) {
+	return sendReply(s, m, replyMessage{Content: content}, false)
+}
+
+//
+// Same as Reply, but pings m's author
+//
+func ReplyMention(s *discordgo.Session, m *discordgo.MessageCreate, content string) (*discordgo.Message, error) {
+	return sendReply(s, m, replyMessage{Content: content}, true)
+}
+
+//
+// Same as Reply, but replies with embed
+//
+func ReplyEmbed(s *discordgo.Session, m *discordgo.MessageCreate, embed *discordgo.MessageEmbed) (*discordgo.Message, error) {
+	if embed.Type == "" {
+		embed.Type = "rich"
+	}
+	return sendReply(s, m, replyMessage{Embed: embed}, false)
+}
+
+/* Message replying to another one, which our version of discordgo can't send */
+type replyMessage struct {
+	Content         string                  `json:"content,omitempty"`
+	Embed           *discordgo.MessageEmbed `json:"embed,omitempty"`
+	Reference       messageReference        `json:"message_reference"`
+	AllowedMentions replyMentions           `json:"allowed_mentions"`
+}
+
+type messageReference struct {
+	MessageID       string `json:"message_id"`
+	ChannelID       string `json:"channel_id"`
+	GuildID         string `json:"guild_id,omitempty"`
+	FailIfNotExists bool   `json:"fail_if_not_exists"`
+}
+
+type replyMentions struct {
+	Parse       []discordgo.AllowedMentionType `json:"parse"`
+	RepliedUser bool                           `json:"replied_user"`
+}
+
+func sendReply(s *discordgo.Session, m *discordgo.MessageCreate, reply replyMessage, mention bool) (*discordgo.Message, error) {
+	reply.Reference = messageReference{MessageID: m.ID, ChannelID: m.ChannelID, GuildID: m.GuildID}
+	/* Mentions in content behave as usual, only pinging the replied user is up to us */
+	reply.AllowedMentions = replyMentions{
+		Parse: []discordgo.AllowedMentionType{
+			discordgo.AllowedMentionTypeUsers,
+			discordgo.AllowedMentionTypeRoles,
+			discordgo.AllowedMentionTypeEveryone,
+		},
+		RepliedUser: mention,
+	}
+	endpoint := discordgo.EndpointChannelMessages(m.ChannelID)
+	body, err := s.RequestWithBucketID("POST", endpoint, reply, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var msg *discordgo.Message
+	err = json.Unmarshal(body, &msg)
+	return msg, err
+}
+
+//
+// Sends up to maxErrorReplies chunks, truncating the rest, each wrapped in block
+//
+func sendChunks(s *discordgo.Session, channelID string, chunks []string, block string) error {
+	if len(chunks) > maxErrorReplies {
+		chunks = chunks[:maxErrorReplies]
+		last := []rune(chunks[maxErrorReplies-1])
+		chunks[maxErrorReplies-1] = string(last[:len(last)-1]) + "…"
+	}
+	for _, chunk := range chunks {
+		if block != "" {
+			chunk = block + "\n" + chunk + "\n" + block
+		}
+		if _, err := s.ChannelMessageSend(channelID, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Splits str into chunks of at most size characters, breaking lines at newlines
+// where possible
+//
+func chunkString(str string, size int) (chunks []string) {
+	for utf8.RuneCountInString(str) > size {
+		/* Byte offset of the size-th rune */
+		end := 0
+		for c := 0; c < size; c++ {
+			_, n := utf8.DecodeRuneInString(str[end:])
+			end += n
+		}
+		if nl := strings.LastIndexByte(str[:end], '\n'); nl > 0 {
+			chunks = append(chunks, str[:nl])
+			str = str[nl+1:]
+		} else {
+			chunks = append(chunks, str[:end])
+			str = str[end:]
+		}
+	}
+	return append(chunks, str)
+}
+
+//
+// Shows the typing indicator in channel with ID channelID until the returned
+// function is called
+//
+func startTyping(s *discordgo.Session, channelID string) (stop func()) {
+	done := make(chan struct{})
+	s.ChannelTyping(channelID)
+	go func() {
+		ticker := time.NewTicker(typingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				s.ChannelTyping(channelID)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+//
+// Removes the reactions on message with ID messageID, for interactive messages (such
+// as paginators) that stopped listening to them, so users don't click dead controls.
+// If the bot can't remove everyone's reactions, lacking Manage Messages, it removes
+// at least its own. If deleteMessage is set, the message is deleted instead.
+//
+func ClearReactions(s *discordgo.Session, channelID, messageID string, deleteMessage bool) error {
+	if deleteMessage {
+		return s.ChannelMessageDelete(channelID, messageID)
+	}
+	if err := s.MessageReactionsRemoveAll(channelID, messageID); err == nil {
+		return nil
+	}
+	msg, err := s.State.Message(channelID, messageID)
+	if err != nil {
+		if msg, err = s.ChannelMessage(channelID, messageID); err != nil {
+			return err
+		}
+	}
+	for _, reaction := range msg.Reactions {
+		if !reaction.Me || reaction.Emoji == nil {
+			continue
+		}
+		if err := s.MessageReactionRemove(channelID, messageID, reaction.Emoji.APIName(), "@me"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Calls ClearReactions once idle passes without the message being interacted with.
+// Calling touch marks an interaction, restarting the timeout; it returns false if
+// the reactions were already cleared.
+//
+func ClearReactionsWhenIdle(
+	s *discordgo.Session,
+	channelID, messageID string,
+	idle time.Duration,
+	deleteMessage bool,
+) (touch func() bool) {
+	timer := time.AfterFunc(idle, func() {
+		ClearReactions(s, channelID, messageID, deleteMessage)
+	})
+	return func() bool {
+		if !timer.Stop() {
+			return false
+		}
+		timer.Reset(idle)
+		return true
+	}
+}
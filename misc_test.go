@@ -0,0 +1,457 @@
+package dgutils
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestParseMessageLink(t *testing.T) {
+	valid := map[string][3]string{
+		"https://discord.com/channels/1/2/3":           {"1", "2", "3"},
+		"https://discordapp.com/channels/1/2/3":        {"1", "2", "3"},
+		"https://canary.discord.com/channels/1/2/3/":   {"1", "2", "3"},
+		"<https://discord.com/channels/@me/2/3>":       {"@me", "2", "3"},
+		"https://ptb.discord.com/channels/10/20/30?x=": {"10", "20", "30"},
+	}
+	for link, ids := range valid {
+		g, c, m, err := ParseMessageLink(link)
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %s", link, err)
+		} else if [3]string{g, c, m} != ids {
+			t.Errorf("'%s': expected %v but got %v", link, ids, [3]string{g, c, m})
+		}
+	}
+
+	invalid := []string{
+		"",
+		"hello",
+		"https://example.com/channels/1/2/3",
+		"https://discord.com/channels/1/2",
+		"https://discord.com/channels/1/2/3/4",
+		"https://discord.com/invite/1/2/3",
+		"https://discord.com/channels/1/@me/3",
+		"https://discord.com/channels/1/2/abc",
+	}
+	for _, link := range invalid {
+		if _, _, _, err := ParseMessageLink(link); err == nil {
+			t.Errorf("'%s': expected an error", link)
+		}
+	}
+}
+
+func TestChunkString(t *testing.T) {
+	cases := []struct {
+		str    string
+		size   int
+		chunks []string
+	}{
+		{"", 4, []string{""}},
+		{"abcd", 4, []string{"abcd"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"ab\ncdef\ngh", 6, []string{"ab", "cdef", "gh"}},
+		{"ñññññ", 2, []string{"ññ", "ññ", "ñ"}},
+	}
+	for _, c := range cases {
+		if chunks := chunkString(c.str, c.size); !reflect.DeepEqual(chunks, c.chunks) {
+			t.Errorf("'%s' in chunks of %d: expected %q but got %q", c.str, c.size, c.chunks, chunks)
+		}
+	}
+}
+
+func TestReplyError(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	m := testMessage("")
+	m.ChannelID = "channel"
+
+	if err := ReplyError(s, m, errors.New(strings.Repeat("ha", 5000))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(reqs) != maxErrorReplies {
+		t.Fatalf("expected %d messages but got %d", maxErrorReplies, len(reqs))
+	}
+	for _, req := range reqs {
+		var msg discordgo.MessageSend
+		body, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(body, &msg)
+		if n := utf8.RuneCountInString(msg.Content); n > maxMessageLength {
+			t.Errorf("sent message with %d characters", n)
+		}
+		if !strings.HasPrefix(msg.Content, "```") || !strings.HasSuffix(msg.Content, "```") {
+			t.Errorf("error isn't in a code block: %s", msg.Content)
+		}
+	}
+}
+
+func TestUserFacing(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	internal := errors.New("pq: connection refused")
+	err := UnmarshalError{Why: UserFacing{"Couldn't look that up, try again later", internal}}
+
+	if err.Why.Error() != internal.Error() || !errors.Is(err.Why, internal) {
+		t.Errorf("expected UserFacing to report its internal error")
+	}
+	if err := ReplyError(s, testMessage(""), err); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var msg discordgo.MessageSend
+	body, _ := ioutil.ReadAll(reqs[0].Body)
+	json.Unmarshal(body, &msg)
+	if len(reqs) != 1 || msg.Content != "Couldn't look that up, try again later" {
+		t.Errorf("expected public message to be sent, got %q", msg.Content)
+	}
+	if got := Userf("no such tag %q", "x").Error(); got != `no such tag "x"` {
+		t.Errorf("unexpected message %s", got)
+	}
+}
+
+func TestReply(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	m := testMessage("!ping")
+	m.ID, m.ChannelID, m.GuildID = "msg", "chan", "guild"
+
+	Reply(s, m, "pong")
+	ReplyMention(s, m, "pong")
+	ReplyEmbed(s, m, &discordgo.MessageEmbed{Title: "pong"})
+	if len(reqs) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(reqs))
+	}
+	for c, mention := range []bool{false, true, false} {
+		var sent replyMessage
+		body, _ := ioutil.ReadAll(reqs[c].Body)
+		json.Unmarshal(body, &sent)
+		if !strings.HasSuffix(reqs[c].URL.Path, "/channels/chan/messages") {
+			t.Errorf("reply %d: sent to %s", c, reqs[c].URL.Path)
+		}
+		if sent.Reference != (messageReference{MessageID: "msg", ChannelID: "chan", GuildID: "guild"}) {
+			t.Errorf("reply %d: unexpected reference %+v", c, sent.Reference)
+		}
+		if sent.AllowedMentions.RepliedUser != mention {
+			t.Errorf("reply %d: expected replied_user to be %v", c, mention)
+		}
+	}
+}
+
+func TestGuildChannels(t *testing.T) {
+	s := testSession()
+	s.State.GuildAdd(&discordgo.Guild{ID: "configured", SystemChannelID: "welcome", RulesChannelID: "rules"})
+	s.State.GuildAdd(&discordgo.Guild{ID: "bare"})
+	for _, id := range []string{"welcome", "rules"} {
+		s.State.ChannelAdd(&discordgo.Channel{ID: id, GuildID: "configured"})
+	}
+
+	if channel, err := SystemChannel(s, "configured"); err != nil || channel.ID != "welcome" {
+		t.Errorf("expected system channel welcome but got (%v, %v)", channel, err)
+	}
+	if channel, err := RulesChannel(s, "configured"); err != nil || channel.ID != "rules" {
+		t.Errorf("expected rules channel rules but got (%v, %v)", channel, err)
+	}
+	if channel, err := SystemChannel(s, "bare"); err != nil || channel != nil {
+		t.Errorf("expected no system channel but got (%v, %v)", channel, err)
+	}
+	if channel, err := RulesChannel(s, "bare"); err != nil || channel != nil {
+		t.Errorf("expected no rules channel but got (%v, %v)", channel, err)
+	}
+}
+
+func TestClearReactions(t *testing.T) {
+	var reqs []*http.Request
+	var lock sync.Mutex /* requests are made from the timer's goroutine as well */
+	s, _ := discordgo.New("Bot test")
+	s.Client = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		lock.Lock()
+		reqs = append(reqs, req)
+		lock.Unlock()
+		status, body := http.StatusOK, "{}"
+		switch {
+		case req.Method == http.MethodDelete && strings.HasSuffix(req.URL.Path, "/reactions"):
+			status, body = http.StatusForbidden, `{"code": 50013, "message": "Missing Permissions"}`
+		case req.Method == http.MethodGet:
+			body = `{"id": "msg", "reactions": [
+				{"count": 2, "me": true, "emoji": {"name": "⬅️"}},
+				{"count": 1, "me": false, "emoji": {"name": "👍"}},
+				{"count": 2, "me": true, "emoji": {"id": "1", "name": "next"}}
+			]}`
+		}
+		return &http.Response{
+			StatusCode: status,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	})}
+
+	if err := ClearReactions(s, "chan", "msg", false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var removed []string
+	for _, req := range reqs[2:] {
+		if req.Method == http.MethodDelete {
+			removed = append(removed, req.URL.Path[strings.Index(req.URL.Path, "/reactions/"):])
+		}
+	}
+	expect := []string{
+		"/reactions/⬅️/@me",
+		"/reactions/next:1/@me",
+	}
+	if !reflect.DeepEqual(removed, expect) {
+		t.Errorf("expected only own reactions to be removed, got %v", removed)
+	}
+
+	lock.Lock()
+	reqs = nil
+	lock.Unlock()
+	touch := ClearReactionsWhenIdle(s, "chan", "msg", 20*time.Millisecond, true)
+	if !touch() {
+		t.Errorf("touch failed before timeout")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if touch() {
+		t.Errorf("touch succeeded after timeout")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(reqs) != 1 || reqs[0].Method != http.MethodDelete || !strings.HasSuffix(reqs[0].URL.Path, "/messages/msg") {
+		t.Errorf("expected message to be deleted, got %v", reqs)
+	}
+}
+
+func TestEscapeContent(t *testing.T) {
+	in := "**bold** _it_ ~~no~~ `code` ||spoiler|| > quote \\o/ @everyone"
+	expect := "\\*\\*bold\\*\\* \\_it\\_ \\~\\~no\\~\\~ \\`code\\` \\|\\|spoiler\\|\\| \\> quote \\\\o/ @everyone"
+	if got := EscapeContent(in); got != expect {
+		t.Errorf("expected %q but got %q", expect, got)
+	}
+}
+
+func TestResolveTarget(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	s.State.MaxMessageCount = 10
+	s.State.GuildAdd(&discordgo.Guild{ID: "guild"})
+	s.State.ChannelAdd(&discordgo.Channel{ID: "chan", GuildID: "guild"})
+	s.State.MessageAdd(&discordgo.Message{ID: "spam", ChannelID: "chan", Author: &discordgo.User{ID: "spammer"}})
+
+	reply := testMessage("!warn flooding")
+	reply.ChannelID = "chan"
+	reply.MessageReference = &discordgo.MessageReference{MessageID: "spam"}
+	reply.Mentions = []*discordgo.User{{ID: "spammer"}, {ID: "bystander"}}
+	mention := testMessage("!warn <@!42> being rude")
+	mention.Mentions = []*discordgo.User{{ID: "42"}}
+	/* Invoked by mention, with mentions listed out of order */
+	byMention := testMessage("<@bot> warn <@43> and <@42>")
+	byMention.Mentions = []*discordgo.User{{ID: "bot"}, {ID: "42"}, {ID: "43"}}
+	trailing := testMessage("<@bot> warn spam by <@42>")
+	trailing.Mentions = []*discordgo.User{{ID: "bot"}, {ID: "42"}}
+
+	cases := []struct {
+		m      *discordgo.MessageCreate
+		args   []string
+		target string
+		rest   []string
+	}{
+		{reply, []string{"flooding"}, "spammer", []string{"flooding"}},
+		{mention, []string{"<@!42>", "being", "rude"}, "42", []string{"being", "rude"}},
+		{byMention, []string{"<@43>", "and", "<@42>"}, "43", []string{"and", "<@42>"}},
+		{trailing, []string{"spam", "by", "<@42>"}, "42", []string{"spam", "by", "<@42>"}},
+	}
+	for _, c := range cases {
+		target, rest, err := ResolveTarget(s, c.m, c.args)
+		if err != nil || target.ID != c.target || !reflect.DeepEqual(rest, c.rest) {
+			t.Errorf("%q: expected (%s, %v) but got (%v, %v, %v)", c.m.Content, c.target, c.rest, target, rest, err)
+		}
+	}
+	if len(reqs) != 0 {
+		t.Errorf("expected targets to be resolved from state, got %v", reqs)
+	}
+
+	if _, rest, err := ResolveTarget(s, testMessage("!warn 1234 rude"), []string{"1234", "rude"}); err != nil ||
+		!reflect.DeepEqual(rest, []string{"rude"}) || len(reqs) != 1 || !strings.HasSuffix(reqs[0].URL.Path, "/users/1234") {
+		t.Errorf("expected user 1234 to be fetched, got (%v, %v), requests %v", rest, err, reqs)
+	}
+	if _, _, err := ResolveTarget(s, testMessage("!warn someone"), []string{"someone"}); err != (NoTarget{}) {
+		t.Errorf("expected NoTarget but got %v", err)
+	}
+	botOnly := testMessage("<@bot> warn someone")
+	botOnly.Mentions = []*discordgo.User{{ID: "bot"}}
+	if _, _, err := ResolveTarget(s, botOnly, []string{"someone"}); err != (NoTarget{}) {
+		t.Errorf("expected the bot not to be its own target, got %v", err)
+	}
+}
+
+func TestEveryonePermissions(t *testing.T) {
+	s := testSession()
+	s.State.GuildAdd(&discordgo.Guild{
+		ID: "guild",
+		Roles: []*discordgo.Role{
+			{ID: "guild", Permissions: discordgo.PermissionAddReactions},
+			{ID: "mod", Permissions: discordgo.PermissionKickMembers},
+		},
+	})
+	s.State.MemberAdd(&discordgo.Member{GuildID: "guild", User: &discordgo.User{ID: "user"}})
+	s.State.MemberAdd(&discordgo.Member{GuildID: "guild", User: &discordgo.User{ID: "mod"}, Roles: []string{"mod"}})
+
+	cases := []struct {
+		user   string
+		perm   int
+		expect bool
+	}{
+		{"user", discordgo.PermissionAddReactions, true},
+		{"user", discordgo.PermissionKickMembers, false},
+		{"mod", discordgo.PermissionAddReactions, true},
+		{"mod", discordgo.PermissionKickMembers, true},
+	}
+	for _, c := range cases {
+		if got, err := MemberHasPermissions(s, "guild", c.user, c.perm); err != nil || got != c.expect {
+			t.Errorf("%s with permission %d: expected %v but got (%v, %v)", c.user, c.perm, c.expect, got, err)
+		}
+	}
+	if perms, _ := MemberPermissions(s, "guild", "mod"); perms != discordgo.PermissionAddReactions|discordgo.PermissionKickMembers {
+		t.Errorf("unexpected permissions %d", perms)
+	}
+}
+
+func TestAdministratorPermissions(t *testing.T) {
+	s := testSession()
+	s.State.GuildAdd(&discordgo.Guild{
+		ID:      "guild",
+		OwnerID: "owner",
+		Roles: []*discordgo.Role{
+			{ID: "guild"},
+			{ID: "admin", Permissions: discordgo.PermissionAdministrator},
+		},
+	})
+	s.State.MemberAdd(&discordgo.Member{GuildID: "guild", User: &discordgo.User{ID: "user"}})
+	s.State.MemberAdd(&discordgo.Member{GuildID: "guild", User: &discordgo.User{ID: "admin"}, Roles: []string{"admin"}})
+	s.State.MemberAdd(&discordgo.Member{GuildID: "guild", User: &discordgo.User{ID: "owner"}})
+
+	for user, expect := range map[string]bool{"user": false, "admin": true, "owner": true} {
+		if got, err := MemberHasPermissions(s, "guild", user, discordgo.PermissionManageMessages); err != nil || got != expect {
+			t.Errorf("%s: expected %v but got (%v, %v)", user, expect, got, err)
+		}
+	}
+	if perms, _ := MemberPermissions(s, "guild", "admin"); perms != discordgo.PermissionAll {
+		t.Errorf("expected administrators to have every permission, got %d", perms)
+	}
+
+	pred := CmdPredicate{Permissions: discordgo.PermissionBanMembers}
+	m := testMessage("")
+	m.GuildID, m.Author.ID = "guild", "admin"
+	if err := pred.Check(s, m); err != nil {
+		t.Errorf("expected administrator to satisfy predicate, got %v", err)
+	}
+}
+
+func TestChannelPermissions(t *testing.T) {
+	s := testSession()
+	s.State.GuildAdd(&discordgo.Guild{
+		ID: "guild",
+		Roles: []*discordgo.Role{
+			{ID: "guild", Permissions: discordgo.PermissionSendMessages},
+			{ID: "mod", Permissions: discordgo.PermissionManageMessages},
+			{ID: "admin", Permissions: discordgo.PermissionAdministrator},
+		},
+		Channels: []*discordgo.Channel{
+			{ID: "announcements", GuildID: "guild", PermissionOverwrites: []*discordgo.PermissionOverwrite{
+				{ID: "guild", Type: "role", Deny: discordgo.PermissionSendMessages},
+				{ID: "mod", Type: "role", Allow: discordgo.PermissionSendMessages},
+				{ID: "muted", Type: "member", Deny: discordgo.PermissionSendMessages},
+			}},
+			{ID: "news", GuildID: "guild", Type: channelTypeGuildPublicThread, ParentID: "announcements"},
+		},
+	})
+	for _, member := range []*discordgo.Member{
+		{User: &discordgo.User{ID: "user"}},
+		{User: &discordgo.User{ID: "mod"}, Roles: []string{"mod"}},
+		{User: &discordgo.User{ID: "muted"}, Roles: []string{"mod"}},
+		{User: &discordgo.User{ID: "admin"}, Roles: []string{"admin"}},
+	} {
+		member.GuildID = "guild"
+		s.State.MemberAdd(member)
+	}
+
+	for _, channel := range []string{"announcements", "news"} {
+		for user, expect := range map[string]bool{"user": false, "mod": true, "muted": false, "admin": true} {
+			got, err := MemberHasChannelPermissions(s, "guild", channel, user, discordgo.PermissionSendMessages)
+			if err != nil || got != expect {
+				t.Errorf("%s in %s: expected %v but got (%v, %v)", user, channel, expect, got, err)
+			}
+		}
+	}
+	if perm, _ := MemberHasPermissions(s, "guild", "user", discordgo.PermissionSendMessages); !perm {
+		t.Errorf("expected overwrites not to affect guild-wide permissions")
+	}
+}
+
+func TestBotOwners(t *testing.T) {
+	BotOwners["operator"] = true
+	defer delete(BotOwners, "operator")
+
+	s := testSession()
+	s.State.GuildAdd(&discordgo.Guild{ID: "guild", OwnerID: "owner"})
+	pred := CmdPredicate{BotOwnerOnly: true}
+	for user, expect := range map[string]bool{"operator": true, "owner": false, "user": false} {
+		if IsBotOwner(user) != expect {
+			t.Errorf("%s: expected IsBotOwner to be %v", user, expect)
+		}
+		m := testMessage("")
+		m.GuildID, m.Author.ID = "guild", user
+		if err := pred.Check(s, m); expect && err != nil || !expect && err != (AccessDenied{}) {
+			t.Errorf("%s: unexpected predicate outcome %v", user, err)
+		}
+	}
+}
+
+/* Session serving guild "guild", with role "mod" and members "user" and "other" */
+func testGuildSession(memberLists *int) *discordgo.Session {
+	s, _ := discordgo.New("Bot test")
+	s.State.User = &discordgo.User{ID: "bot"}
+	s.Client = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		body := `{"id": "guild", "name": "Guild"}`
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/guilds/guild/roles"):
+			body = `[{"id": "mod", "name": "Moderators"}]`
+		case strings.HasSuffix(req.URL.Path, "/guilds/guild/members"):
+			*memberLists++
+			body = `[{"user": {"id": "user"}}, {"user": {"id": "other"}, "roles": ["mod"]}]`
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	})}
+	return s
+}
+
+func TestWarmGuild(t *testing.T) {
+	var lists int
+	s := testGuildSession(&lists)
+	if err := WarmGuild(s, "guild"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := s.State.Role("guild", "mod"); err != nil {
+		t.Errorf("expected role to be in state: %s", err)
+	}
+	if member, err := s.State.Member("guild", "other"); err != nil {
+		t.Errorf("expected member to be in state: %s", err)
+	} else if !reflect.DeepEqual(member.Roles, []string{"mod"}) {
+		t.Errorf("expected member to have role mod, got %v", member.Roles)
+	}
+	if lists != 1 {
+		t.Errorf("expected a single batch of members, got %d", lists)
+	}
+}
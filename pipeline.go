@@ -0,0 +1,115 @@
+package dgutils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	pipeToken          = "|"
+	defaultMaxPipeline = 5
+)
+
+//
+// Same as Handle, but supports piping commands into each other, as in
+// !roll 6 | !repeat 3
+// Commands are run in order, with the reply of each command appended as the last
+// argument of the next one; only the reply of the last command is sent. Commands
+// other than the last must reply with some text. The pipe must be a token of its
+// own, so with the default tokenizer it has to be surrounded by spaces.
+// Every command goes through middleware, Observer and Logf as if invoked on its own,
+// and unknown commands past the first fail with NoSuchCommand (the first is treated
+// as by Handle, see ReportUnknown).
+// Pipelines are limited to MaxPipeline commands, or 5 if it's zero
+//
+func (reg *CmdRegistry) HandlePipeline(
+	s *discordgo.Session,
+	msg *discordgo.MessageCreate,
+	pfx string,
+	errHandler CmdErrorHandler,
+) {
+	/* Stages share a request ID, they're all part of the same message */
+	id := newRequestID()
+	cmd, err := reg.dispatchPipeline(id, s, msg, pfx)
+	routeError(id, s, msg, cmd, err, errHandler)
+}
+
+func (reg *CmdRegistry) dispatchPipeline(
+	id RequestID,
+	s *discordgo.Session,
+	msg *discordgo.MessageCreate,
+	pfx string,
+) (cmd Cmd, err error) {
+	args, err := reg.parse(id, s, msg, []string{pfx})
+	if err != nil || len(args) == 0 {
+		return
+	}
+	if err = reg.GlobalPredicate.check(reg.permissions(), s, msg); err != nil {
+		return
+	}
+	if reg.Get(args[0]) == nil {
+		if reg.ReportUnknown {
+			err = NoSuchCommand{args[0]}
+		}
+		return
+	}
+
+	var stages [][]string
+	start := 0
+	for c, arg := range args {
+		if arg == pipeToken {
+			stages = append(stages, args[start:c])
+			start = c + 1
+		}
+	}
+	stages = append(stages, args[start:])
+	max := reg.MaxPipeline
+	if max == 0 {
+		max = defaultMaxPipeline
+	}
+	if len(stages) > max {
+		err = PipelineTooLong{max, len(stages)}
+		return
+	}
+
+	var input []string
+	for c, stage := range stages {
+		if len(stage) == 0 {
+			return nil, errors.New("HandlePipeline: empty command in pipeline")
+		}
+		/* Later commands may or may not be prefixed */
+		name := stage[0]
+		if c > 0 && strings.HasPrefix(name, pfx) {
+			name = strings.TrimPrefix(name, pfx)
+		}
+		var canon string
+		if cmd, canon = reg.resolve(name); cmd == nil {
+			return nil, NoSuchCommand{name}
+		}
+		cmdArgs := append(append([]string{}, stage[1:]...), input...)
+		if c == len(stages)-1 {
+			inv := reg.invocation(id, canon)
+			err = reg.invokeAs(inv, cmd, s, msg, cmdArgs)
+			return inv.resolved(cmd), err
+		}
+
+		if _, ok := cmd.(replyingCmd); !ok {
+			return cmd, fmt.Errorf("HandlePipeline: %s can't be piped", name)
+		}
+		/* Through invoke all the same, so that every stage is observed and logged */
+		inv := reg.invocation(id, canon)
+		inv.capture = true
+		if err = reg.invokeAs(inv, cmd, s, msg, cmdArgs); err != nil {
+			return
+		}
+		reply := inv.reply
+		if reply == nil || reply.Content == "" {
+			return cmd, fmt.Errorf("HandlePipeline: %s has no output to pipe", name)
+		}
+		input = []string{reply.Content}
+	}
+	return
+}
@@ -0,0 +1,103 @@
+package dgutils
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestHandlePipeline(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	reg := Registry()
+	reg.Add("echo", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, words []string) string {
+		return strings.Join(words, " ")
+	}, "", nil))
+	reg.Add("upper", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, str string) string {
+		return strings.ToUpper(str)
+	}, "", nil))
+	reg.Add("nothing", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, words []string) {}, "", nil))
+	reg.MaxPipeline = 3
+
+	var errs []error
+	handler := func(s *discordgo.Session, m *discordgo.MessageCreate, err error) {
+		errs = append(errs, err)
+	}
+
+	reg.HandlePipeline(s, testMessage("!echo hello there | !upper"), "!", handler)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected error: %v", errs)
+	}
+	if len(reqs) != 1 {
+		t.Fatalf("expected a single reply, got %d", len(reqs))
+	}
+	var reply discordgo.MessageSend
+	body, _ := ioutil.ReadAll(reqs[0].Body)
+	json.Unmarshal(body, &reply)
+	if reply.Content != "HELLO THERE" {
+		t.Errorf("expected 'HELLO THERE' but got '%s'", reply.Content)
+	}
+
+	for content, expect := range map[string]string{
+		"!echo a | echo | echo | echo": "pipeline has 4 commands, limit is 3",
+		"!nothing | echo":              "HandlePipeline: nothing has no output to pipe",
+		"!echo a | bogus":              "no such command bogus",
+		"!echo a |":                    "HandlePipeline: empty command in pipeline",
+	} {
+		errs = nil
+		reg.HandlePipeline(s, testMessage(content), "!", handler)
+		if len(errs) != 1 || errs[0].Error() != expect {
+			t.Errorf("'%s': expected error '%s' but got %v", content, expect, errs)
+		}
+	}
+}
+
+func TestPipelineObserved(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	failure := errors.New("out of coffee")
+	obs := &testObserver{}
+	reg := Registry()
+	reg.Observer = obs
+	reg.Add("fail", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) (string, error) {
+		return "", failure
+	}, "", nil))
+	reg.Add("echo", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, words []string) string {
+		return strings.Join(words, " ")
+	}, "", nil))
+	var used []string
+	reg.Use(func(next Cmd) Cmd {
+		return aroundCmd{next, func(next Cmd, s *discordgo.Session, m *discordgo.MessageCreate, args []string) error {
+			used = append(used, strings.Join(args, " "))
+			return next.Invoke(s, m, args)
+		}}
+	})
+
+	if _, err := reg.dispatchPipeline(newRequestID(), s, testMessage("!echo a | echo"), "!"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expect := []string{"a", "a"}; !reflect.DeepEqual(used, expect) || len(obs.names) != 2 || obs.ids[0] != obs.ids[1] {
+		t.Errorf("expected both stages to go through middleware and be observed under one ID, got %v and %v", used, obs.ids)
+	}
+	if len(reqs) != 1 {
+		t.Errorf("expected only the last stage's reply to be sent, got %d", len(reqs))
+	}
+
+	obs.names, obs.errs = nil, nil
+	if _, err := reg.dispatchPipeline(newRequestID(), s, testMessage("!fail | echo"), "!"); err != failure {
+		t.Errorf("expected %v but got %v", failure, err)
+	}
+	if len(obs.names) != 1 || obs.names[0] != "fail" || obs.errs[0] != failure {
+		t.Errorf("expected the failing stage to be observed, got %v %v", obs.names, obs.errs)
+	}
+	var missing NoSuchCommand
+	if _, err := reg.dispatchPipeline(newRequestID(), s, testMessage("!echo a | bogus"), "!"); !errors.As(err, &missing) {
+		t.Errorf("expected NoSuchCommand but got %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package dgutils
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+//
+// Returns a CmdPredicateFunc satisfied only if all of funcs are. They're
+// evaluated in order, stopping at the first one that isn't satisfied
+//
+func And(funcs ...CmdPredicateFunc) CmdPredicateFunc {
+	return func(s *discordgo.Session, m *discordgo.MessageCreate, p CmdPredicate) bool {
+		for _, fn := range funcs {
+			if !fn(s, m, p) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+//
+// Returns a CmdPredicateFunc satisfied if any of funcs is. They're evaluated in
+// order, stopping at the first one that is satisfied
+//
+func Or(funcs ...CmdPredicateFunc) CmdPredicateFunc {
+	return func(s *discordgo.Session, m *discordgo.MessageCreate, p CmdPredicate) bool {
+		for _, fn := range funcs {
+			if fn(s, m, p) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+//
+// Returns a CmdPredicateFunc satisfied only if fn isn't
+//
+func Not(fn CmdPredicateFunc) CmdPredicateFunc {
+	return func(s *discordgo.Session, m *discordgo.MessageCreate, p CmdPredicate) bool {
+		return !fn(s, m, p)
+	}
+}
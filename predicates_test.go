@@ -0,0 +1,44 @@
+package dgutils
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestCombinators(t *testing.T) {
+	var calls []string
+	pred := CmdPredicate{Category: "staff"}
+	check := func(name string, result bool) CmdPredicateFunc {
+		return func(s *discordgo.Session, m *discordgo.MessageCreate, p CmdPredicate) bool {
+			if p.Category != pred.Category {
+				t.Errorf("%s: predicate wasn't forwarded, got %+v", name, p)
+			}
+			calls = append(calls, name)
+			return result
+		}
+	}
+	yes, no := check("yes", true), check("no", false)
+
+	cases := []struct {
+		fn     CmdPredicateFunc
+		expect bool
+		calls  int
+	}{
+		{And(yes, no, yes), false, 2},
+		{And(yes, yes), true, 2},
+		{And(), true, 0},
+		{Or(no, yes, no), true, 2},
+		{Or(no, no), false, 2},
+		{Or(), false, 0},
+		{Not(no), true, 1},
+		{Or(no, And(yes, Not(no))), true, 3},
+	}
+	s, m := testSession(), testMessage("")
+	for c, test := range cases {
+		calls = nil
+		if got := test.fn(s, m, pred); got != test.expect || len(calls) != test.calls {
+			t.Errorf("case %d: expected %v after %d calls, got %v after %v", c, test.expect, test.calls, got, calls)
+		}
+	}
+}
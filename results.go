@@ -0,0 +1,66 @@
+package dgutils
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+//
+// Outcome of a command's operation on one of several targets, such as each user
+// given to a ban command. Target is how the target is shown to users, i.e. a mention,
+// and Err is why the operation failed for it, or nil if it succeeded. Commands may
+// return a []TargetResult to reply with a summary of them, see TargetSummary.
+//
+type TargetResult struct {
+	Target string
+	Err    error
+}
+
+//
+// Summarizes results, counting successes and listing failures along with their
+// reasons, one per line, i.e.
+//
+//	2 succeeded, 1 failed:
+//	@c — missing permissions
+//
+// Reasons are the public message of UserFacing errors, or the error itself.
+// Returns an empty string if there are no results.
+//
+func TargetSummary(results []TargetResult) string {
+	if len(results) == 0 {
+		return ""
+	}
+	var failures []string
+	for _, result := range results {
+		if result.Err == nil {
+			continue
+		}
+		reason, ok := publicMessage(result.Err)
+		if !ok {
+			reason = result.Err.Error()
+		}
+		failures = append(failures, result.Target+" — "+reason)
+	}
+	summary := fmt.Sprintf("%d succeeded", len(results)-len(failures))
+	if len(failures) > 0 {
+		summary += fmt.Sprintf(", %d failed:\n%s", len(failures), strings.Join(failures, "\n"))
+	}
+	return summary
+}
+
+//
+// Reply for commands returning results. Targets are usually mentions, which
+// shouldn't ping anyone when listed
+//
+func targetReply(results []TargetResult) *discordgo.MessageSend {
+	summary := TargetSummary(results)
+	if summary == "" {
+		return nil
+	}
+	return &discordgo.MessageSend{
+		Content:         summary,
+		AllowedMentions: &discordgo.MessageAllowedMentions{Parse: []discordgo.AllowedMentionType{}},
+	}
+}
@@ -0,0 +1,47 @@
+package dgutils
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestTargetSummary(t *testing.T) {
+	results := []TargetResult{
+		{Target: "<@a>"},
+		{Target: "<@b>"},
+		{Target: "<@c>", Err: errors.New("missing permissions")},
+		{Target: "<@d>", Err: UserFacing{Public: "they're the owner", Err: errors.New("403")}},
+	}
+	expect := "2 succeeded, 2 failed:\n<@c> — missing permissions\n<@d> — they're the owner"
+	if summary := TargetSummary(results); summary != expect {
+		t.Errorf("expected %q but got %q", expect, summary)
+	}
+	if summary := TargetSummary(results[:2]); summary != "2 succeeded" {
+		t.Errorf("expected only successes, got %q", summary)
+	}
+	if summary := TargetSummary(nil); summary != "" {
+		t.Errorf("expected no summary, got %q", summary)
+	}
+
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	reg := Registry()
+	reg.Add("ban", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, users []string) []TargetResult {
+		return results
+	}, "", nil))
+	if err := reg.Exec(s, testMessage(""), "ban"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(reqs) != 1 {
+		t.Fatalf("expected a single reply, got %d requests", len(reqs))
+	}
+	body, _ := ioutil.ReadAll(reqs[0].Body)
+	if !strings.Contains(string(body), "2 succeeded, 2 failed") || !strings.Contains(string(body), `"parse":[]`) {
+		t.Errorf("expected summary not mentioning anyone, got %s", body)
+	}
+}
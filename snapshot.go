@@ -0,0 +1,75 @@
+package dgutils
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+//
+// Copy of a register's commands taken at some point, see CmdRegistry.Snapshot.
+// Cmds are sorted by name, and Aliases maps aliases to the name of the command they
+// point to. Changes to the register after the snapshot was taken aren't reflected
+// in it, and it may be used from any goroutine.
+//
+type CmdSnapshot struct {
+	Cmds    []CmdInfo
+	Aliases map[string]string
+}
+
+//
+// Describes a command in a CmdSnapshot. Help is empty for commands that aren't
+// created by Command (or wrap one), and Predicate is the zero predicate for those
+// without a PredicateInfo method. Invocations is the command's count as reported by
+// CmdRegistry.Popularity.
+//
+type CmdInfo struct {
+	Name        string
+	Aliases     []string /* sorted */
+	Help        string
+	Predicate   CmdPredicate
+	Invocations uint64
+}
+
+//
+// Takes a snapshot of the commands and aliases in the register, including its
+// parent's, for listing them (i.e. in help commands or dashboards) without holding
+// the register's lock or racing with changes to it
+//
+func (reg *CmdRegistry) Snapshot() CmdSnapshot {
+	cmds, aliases := reg.effective()
+	snap := CmdSnapshot{Cmds: make([]CmdInfo, 0, len(cmds)), Aliases: aliases}
+	byDest := map[string][]string{}
+	for alias, dest := range aliases {
+		byDest[dest] = append(byDest[dest], alias)
+	}
+	for name, cmd := range cmds {
+		info := CmdInfo{Name: name, Aliases: byDest[name], Help: cmdHelp(cmd)}
+		sort.Strings(info.Aliases)
+		if pred, ok := cmd.(interface{ PredicateInfo() CmdPredicate }); ok {
+			info.Predicate = pred.PredicateInfo()
+		}
+		if counter, ok := reg.stats.Load(name); ok {
+			info.Invocations = atomic.LoadUint64(counter.(*uint64))
+		}
+		snap.Cmds = append(snap.Cmds, info)
+	}
+	sort.Slice(snap.Cmds, func(i, j int) bool {
+		return snap.Cmds[i].Name < snap.Cmds[j].Name
+	})
+	return snap
+}
+
+//
+// Returns the help string of cmd, looking into commands wrapped by this package
+//
+func cmdHelp(cmd Cmd) string {
+	switch cmd := cmd.(type) {
+	case *FnCmd:
+		return cmd.Help
+	case predicatedCmd:
+		return cmdHelp(cmd.Cmd)
+	case loggingCmd:
+		return cmdHelp(cmd.Cmd)
+	}
+	return ""
+}
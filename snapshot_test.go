@@ -0,0 +1,35 @@
+package dgutils
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestSnapshot(t *testing.T) {
+	reg := Registry()
+	reg.Add("echo", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+	}, "Repeats things", nil))
+	reg.Add("kick", WithPredicate(MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+	}, "Kicks people", nil), CmdPredicate{Permissions: discordgo.PermissionKickMembers}))
+	reg.Alias("say", "echo")
+	reg.Alias("repeat", "echo")
+	reg.Exec(testSession(), testMessage(""), "say")
+
+	snap := reg.Snapshot()
+	reg.Add("late", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+	}, "", nil))
+	reg.Alias("shout", "echo")
+
+	expect := []CmdInfo{
+		{Name: "echo", Aliases: []string{"repeat", "say"}, Help: "Repeats things", Invocations: 1},
+		{Name: "kick", Help: "Kicks people", Predicate: CmdPredicate{Permissions: discordgo.PermissionKickMembers}},
+	}
+	if !reflect.DeepEqual(snap.Cmds, expect) {
+		t.Errorf("expected %+v but got %+v", expect, snap.Cmds)
+	}
+	if !reflect.DeepEqual(snap.Aliases, map[string]string{"say": "echo", "repeat": "echo"}) {
+		t.Errorf("unexpected aliases %v", snap.Aliases)
+	}
+}
@@ -0,0 +1,127 @@
+package dgutils
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+/*
+ * Registers double as commands, so that related commands can be grouped
+ * under a common name, as in !config get and !config set
+ */
+
+//
+// Invokes the subcommand named by the first of args with the rest of them, so
+// that a register can be added to another as a command:
+//
+//	config := Registry()
+//	config.Add("get", get)
+//	config.Add("set", set)
+//	reg.Add("config", config)
+//
+// When invoked through a register, subcommands use its configuration (converters,
+// permissions and so on), and their errors are routed to their own error handler,
+// or to the one given to the register if they don't have one.
+// Without arguments, Default is invoked, or MissingSubcommand is returned if it's
+// nil. Unknown subcommands fail with NoSuchCommand, except for help tokens (see
+// CmdRegistry.HelpTokens), which are replied to with the usage of every subcommand.
+//
+func (reg *CmdRegistry) Invoke(s *discordgo.Session, m *discordgo.MessageCreate, args []string) error {
+	return invokeStandalone(reg, s, m, args)
+}
+
+//
+// Registers have no error handler of their own, errors go to their subcommands',
+// see Invoke
+//
+func (reg *CmdRegistry) ErrorHandler() CmdErrorHandler {
+	return nil
+}
+
+func (reg *CmdRegistry) invokeReply(
+	inv *invocation,
+	s *discordgo.Session,
+	m *discordgo.MessageCreate,
+	args []string,
+) (*discordgo.MessageSend, error) {
+	if len(args) == 0 {
+		if reg.Default == nil {
+			cmds, _ := reg.effective()
+			missing := MissingSubcommand{Name: inv.name}
+			for name := range cmds {
+				missing.Subcommands = append(missing.Subcommands, name)
+			}
+			sort.Strings(missing.Subcommands)
+			return nil, missing
+		}
+		inv.handleWith(reg.Default)
+		return invokeWrapped(reg.Default, inv, s, m, args)
+	}
+	cmd, name := reg.resolve(args[0])
+	if cmd == nil {
+		helpTokens := inv.reg
+		if helpTokens == nil {
+			helpTokens = reg
+		}
+		if helpTokens.isHelpToken(args) {
+			return &discordgo.MessageSend{Content: reg.usage(inv.name)}, nil
+		}
+		return nil, NoSuchCommand{joinName(inv.name, args[0])}
+	}
+	inv.handleWith(cmd)
+	sub := &invocation{
+		reg:     inv.reg,
+		name:    joinName(inv.name, name),
+		id:      inv.id,
+		pending: inv.pending,
+		handler: inv.handler,
+	}
+	reply, err := invokeWrapped(cmd, sub, s, m, args[1:])
+	if sub.converted {
+		reg.count(name)
+		inv.converted = true
+	}
+	return reply, err
+}
+
+//
+// Routes the invocation's errors to cmd's error handler, if it has one
+//
+func (inv *invocation) handleWith(cmd Cmd) {
+	if handler := cmd.ErrorHandler(); handler != nil && inv.handler != nil {
+		*inv.handler = handler
+	}
+}
+
+//
+// Lists the usage of every subcommand of the group invoked as name, see Invoke
+//
+func (reg *CmdRegistry) usage(name string) string {
+	cmds, _ := reg.effective()
+	names := make([]string, 0, len(cmds))
+	for sub := range cmds {
+		names = append(names, sub)
+	}
+	sort.Strings(names)
+	lines := make([]string, len(names))
+	for c, sub := range names {
+		if fn, ok := cmds[sub].(*FnCmd); ok {
+			lines[c] = fn.usage(joinName(name, sub))
+		} else {
+			lines[c] = "`" + joinName(name, sub) + "`"
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+//
+// Name of subcommand sub of the command name, which is empty outside registers
+//
+func joinName(name, sub string) string {
+	if name == "" {
+		return sub
+	}
+	return name + " " + sub
+}
@@ -0,0 +1,134 @@
+package dgutils
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestSubcommands(t *testing.T) {
+	s := testSession()
+	var got []string
+	record := func(name string) Cmd {
+		return MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+			got = append([]string{name}, args...)
+		}, "", nil)
+	}
+	config := Registry()
+	config.Add("get", record("get"))
+	config.Add("set", record("set"))
+	config.Alias("put", "set")
+	reg := Registry()
+	reg.Add("config", config)
+
+	for content, expect := range map[string][]string{
+		"!config get prefix":   {"get", "prefix"},
+		"!config put prefix ?": {"set", "prefix", "?"},
+	} {
+		got = nil
+		if handled, _, err := reg.Dispatch(s, testMessage(content), "!"); !handled || err != nil {
+			t.Errorf("%q: unexpected result (%v, %v)", content, handled, err)
+		} else if !reflect.DeepEqual(got, expect) {
+			t.Errorf("%q: expected %q but got %q", content, expect, got)
+		}
+	}
+
+	_, _, err := reg.Dispatch(s, testMessage("!config bogus"), "!")
+	if err != (NoSuchCommand{"config bogus"}) {
+		t.Errorf("expected NoSuchCommand but got %v", err)
+	}
+	_, _, err = reg.Dispatch(s, testMessage("!config"), "!")
+	if !reflect.DeepEqual(err, MissingSubcommand{"config", []string{"get", "set"}}) {
+		t.Errorf("expected MissingSubcommand but got %v", err)
+	}
+	config.Default = record("show")
+	got = nil
+	if _, _, err = reg.Dispatch(s, testMessage("!config"), "!"); err != nil || !reflect.DeepEqual(got, []string{"show"}) {
+		t.Errorf("expected default subcommand to run, got %q and %v", got, err)
+	}
+
+	if err := config.Invoke(s, testMessage(""), []string{"get", "x"}); err != nil || !reflect.DeepEqual(got, []string{"get", "x"}) {
+		t.Errorf("expected standalone invocation to run get, got %q and %v", got, err)
+	}
+
+	expect := "config\n  get\n  set [put]\n"
+	if tree := reg.Tree(); tree != expect {
+		t.Errorf("expected tree\n%s\nbut got\n%s", expect, tree)
+	}
+}
+
+func TestSubcommandErrorHandler(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	var own, fallback error
+	failing := errors.New("failing")
+	config := Registry()
+	config.Add("get", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) error {
+		return failing
+	}, "", func(s *discordgo.Session, m *discordgo.MessageCreate, err error) {
+		own = err
+	}))
+	config.Add("set", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) error {
+		return failing
+	}, "", nil))
+	reg := Registry()
+	reg.Add("config", config)
+	handler := func(s *discordgo.Session, m *discordgo.MessageCreate, err error) {
+		fallback = err
+	}
+
+	reg.Handle(s, testMessage("!config get"), "!", handler)
+	if !errors.Is(own, failing) || fallback != nil {
+		t.Errorf("expected subcommand's error handler to be called, got (%v, %v)", own, fallback)
+	}
+	own = nil
+	reg.Handle(s, testMessage("!config set"), "!", handler)
+	if own != nil || !errors.Is(fallback, failing) {
+		t.Errorf("expected register's error handler to be called, got (%v, %v)", own, fallback)
+	}
+	fallback = nil
+	reg.Handle(s, testMessage("!config bogus"), "!", handler)
+	if own != nil || !errors.Is(fallback, NoSuchCommand{"config bogus"}) {
+		t.Errorf("expected register's error handler to be called, got (%v, %v)", own, fallback)
+	}
+}
+
+func TestSubcommandHelp(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	config := Registry()
+	config.Add("get", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, key string) {
+	}, "Shows a setting", nil))
+	config.Add("reset", Registry())
+	reg := Registry()
+	reg.HelpTokens = []string{"help"}
+	reg.Add("config", config)
+
+	if _, _, err := reg.Dispatch(s, testMessage("!config help"), "!"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(reqs) != 1 {
+		t.Fatalf("expected help to be sent, got %d requests", len(reqs))
+	}
+	body, _ := ioutil.ReadAll(reqs[0].Body)
+	var sent discordgo.MessageSend
+	if err := json.Unmarshal(body, &sent); err != nil {
+		t.Fatalf("cannot decode reply: %s", err)
+	}
+	if expect := "`config get <text>`\nShows a setting\n`config reset`"; sent.Content != expect {
+		t.Errorf("expected help\n%s\nbut got\n%s", expect, sent.Content)
+	}
+
+	if err := config.Invoke(s, testMessage(""), []string{"help"}); err != (NoSuchCommand{"help"}) {
+		t.Errorf("expected NoSuchCommand without help tokens but got %v", err)
+	}
+	config.HelpTokens = []string{"?"}
+	if err := config.Invoke(s, testMessage(""), []string{"?"}); err != nil || len(reqs) != 2 {
+		t.Errorf("expected standalone help to be sent, got %v and %d requests", err, len(reqs))
+	}
+}
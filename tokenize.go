@@ -0,0 +1,149 @@
+package dgutils
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//
+// Splits content into arguments on runs of whitespace, the default tokenizer of
+// registers. Arguments may be quoted with double or single quotes to include
+// whitespace, i.e. !say "hello world" takes a single argument, and "" is an empty
+// argument. Quotes only count at the start of an argument, so apostrophes in words
+// are left alone. A backslash escapes a following quote, whitespace or backslash;
+// other backslashes are kept as they are.
+// Code blocks, as well as JSON objects and arrays, starting an argument are kept
+// as they are, along with any whitespace and quotes in them, so that they reach
+// their parameters (see JSONArg) intact. They have to be closed for that; otherwise,
+// as with backticks and brackets anywhere else, they're split like any other text.
+// Unterminated quotes take the rest of content.
+//
+func Tokenize(content string) []string {
+	tokens, _ := tokenize(content)
+	return tokens
+}
+
+//
+// Same as Tokenize, but also returns where each token starts and ends in content,
+// quotes included, so that the raw text spanned by a run of tokens can be recovered
+//
+func tokenize(content string) (tokens []string, spans [][2]int) {
+	var token strings.Builder
+	inToken := false /* whether there's a token to flush, possibly empty */
+	start := 0       /* where the token being built starts */
+	for i := 0; i < len(content); {
+		r, size := utf8.DecodeRuneInString(content[i:])
+		if !inToken {
+			start = i
+		}
+		switch {
+		case r == '\\' && isEscapable(content[i+size:], true):
+			next, n := utf8.DecodeRuneInString(content[i+size:])
+			token.WriteRune(next)
+			size += n
+		case !inToken && r == '`' && codeEnd(content[i:]) > 0:
+			size = codeEnd(content[i:])
+			token.WriteString(content[i : i+size])
+		case !inToken && (r == '{' || r == '[') && jsonEnd(content[i:]) > 0:
+			size = jsonEnd(content[i:])
+			token.WriteString(content[i : i+size])
+		case !inToken && (r == '"' || r == '\''):
+			quoted, n := unquote(content[i:])
+			token.WriteString(quoted)
+			size = n
+		case unicode.IsSpace(r):
+			if inToken {
+				tokens = append(tokens, token.String())
+				spans = append(spans, [2]int{start, i})
+				token.Reset()
+				inToken = false
+			}
+			i += size
+			continue
+		default:
+			token.WriteRune(r)
+		}
+		inToken = true
+		i += size
+	}
+	if inToken {
+		tokens = append(tokens, token.String())
+		spans = append(spans, [2]int{start, len(content)})
+	}
+	return
+}
+
+//
+// Whether a backslash followed by str escapes its first rune. Whitespace can only
+// be escaped outside quotes
+//
+func isEscapable(str string, space bool) bool {
+	r, size := utf8.DecodeRuneInString(str)
+	return size > 0 && (r == '"' || r == '\'' || r == '\\' || (space && unicode.IsSpace(r)))
+}
+
+//
+// Returns the contents of the quoted string str starts with, and how many bytes of
+// str it spans, quotes included
+//
+func unquote(str string) (string, int) {
+	var b strings.Builder
+	quote := str[0]
+	for i := 1; i < len(str); i++ {
+		switch c := str[i]; {
+		case c == '\\' && isEscapable(str[i+1:], false):
+			i++
+			b.WriteByte(str[i])
+		case c == quote:
+			return b.String(), i + 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), len(str)
+}
+
+//
+// Returns the length in bytes of the code block or inline code str starts with, or
+// 0 if it isn't closed
+//
+func codeEnd(str string) int {
+	fence := "`"
+	if strings.HasPrefix(str, "```") {
+		fence = "```"
+	}
+	end := strings.Index(str[len(fence):], fence)
+	if end < 0 {
+		return 0
+	}
+	return len(fence) + end + len(fence)
+}
+
+//
+// Returns the length in bytes of the JSON object or array str starts with, or 0 if
+// it isn't closed. Only brackets and strings are looked at, the JSON itself is
+// validated when parsed
+//
+func jsonEnd(str string) int {
+	depth := 0
+	inString, escaped := false, false
+	for i := 0; i < len(str); i++ {
+		switch c := str[i]; {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			if depth--; depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
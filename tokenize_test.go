@@ -0,0 +1,38 @@
+package dgutils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	for content, expect := range map[string][]string{
+		"":                        nil,
+		"   ":                     nil,
+		"roll 6":                  {"roll", "6"},
+		"roll  6\t\n2":            {"roll", "6", "2"},
+		`say "hello world"`:       {"say", "hello world"},
+		`say 'hello world' again`: {"say", "hello world", "again"},
+		`set key ""`:              {"set", "key", ""},
+		`say don't stop`:          {"say", "don't", "stop"},
+		`say "she said \"hi\""`:   {"say", `she said "hi"`},
+		`say \"not quoted\"`:      {"say", `"not`, `quoted"`},
+		`say hello\ world`:        {"say", "hello world"},
+		`open C:\Users\bot`:       {"open", `C:\Users\bot`},
+		`say "unterminated quote`: {"say", "unterminated quote"},
+		`say ""x`:                 {"say", "x"},
+		"eval `a \"b\"` c":        {"eval", "`a \"b\"`", "c"},
+		"eval ```go\nfmt.Println(\"hi there\")\n```": {"eval", "```go\nfmt.Println(\"hi there\")\n```"},
+		`config {"prefix": "? ", "list": [1, 2]} x`:  {"config", `{"prefix": "? ", "list": [1, 2]}`, "x"},
+		`config {"brace": "}"}`:                      {"config", `{"brace": "}"}`},
+		`config {"open": 1`:                          {"config", `{"open":`, "1"},
+		"note [urgent buy milk":                      {"note", "[urgent", "buy", "milk"},
+		"say it`s fine really":                       {"say", "it`s", "fine", "really"},
+		"say `unclosed code":                         {"say", "`unclosed", "code"},
+		"🎲 roll":                                     {"🎲", "roll"},
+	} {
+		if got := Tokenize(content); !reflect.DeepEqual(got, expect) {
+			t.Errorf("%q: expected %q but got %q", content, expect, got)
+		}
+	}
+}
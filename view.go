@@ -0,0 +1,56 @@
+package dgutils
+
+import "github.com/bwmarrin/discordgo"
+
+//
+// Mutating methods of a register, guarded by a predicate checked against the
+// message that triggered the change. See CmdRegistry.MutableView
+//
+type CmdMutableView struct {
+	reg   *CmdRegistry
+	guard CmdPredicate
+}
+
+//
+// Same as CmdRegistry.Add, but fails with the guard's error (i.e. AccessDenied) if
+// m doesn't satisfy it
+//
+func (v *CmdMutableView) Add(s *discordgo.Session, m *discordgo.MessageCreate, name string, cmd Cmd) error {
+	if err := v.guard.check(v.reg.permissions(), s, m); err != nil {
+		return err
+	}
+	return v.reg.Add(name, cmd)
+}
+
+//
+// Same as CmdRegistry.Alias, but fails with the guard's error (i.e. AccessDenied) if
+// m doesn't satisfy it
+//
+func (v *CmdMutableView) Alias(s *discordgo.Session, m *discordgo.MessageCreate, name, dest string) error {
+	if err := v.guard.check(v.reg.permissions(), s, m); err != nil {
+		return err
+	}
+	return v.reg.Alias(name, dest)
+}
+
+//
+// Same as CmdRegistry.Remove, but fails with the guard's error (i.e. AccessDenied) if
+// m doesn't satisfy it
+//
+func (v *CmdMutableView) Remove(s *discordgo.Session, m *discordgo.MessageCreate, name string) error {
+	if err := v.guard.check(v.reg.permissions(), s, m); err != nil {
+		return err
+	}
+	return v.reg.Remove(name)
+}
+
+//
+// Same as CmdRegistry.Unalias, but fails with the guard's error (i.e. AccessDenied)
+// if m doesn't satisfy it
+//
+func (v *CmdMutableView) Unalias(s *discordgo.Session, m *discordgo.MessageCreate, name string) error {
+	if err := v.guard.check(v.reg.permissions(), s, m); err != nil {
+		return err
+	}
+	return v.reg.Unalias(name)
+}
@@ -0,0 +1,69 @@
+package dgutils
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestMutableView(t *testing.T) {
+	s := testSession()
+	reg := Registry()
+	view := reg.MutableView(CmdPredicate{
+		Custom: func(s *discordgo.Session, m *discordgo.MessageCreate, p CmdPredicate) bool {
+			return m.Author.ID == "staff"
+		},
+	})
+	reg.Add("ping", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {}, "", nil))
+
+	if err := view.Alias(s, testMessage("!alias p ping"), "p", "ping"); err != (AccessDenied{}) {
+		t.Errorf("expected AccessDenied but got %v", err)
+	}
+	m := testMessage("!alias p ping")
+	m.Author.ID = "staff"
+	if err := view.Alias(s, m, "p", "ping"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if reg.Canon("p") != "ping" {
+		t.Errorf("alias wasn't created")
+	}
+
+	if err := view.Unalias(s, testMessage("!unalias p"), "p"); err != (AccessDenied{}) {
+		t.Errorf("expected AccessDenied but got %v", err)
+	}
+	if err := view.Remove(s, testMessage("!remove ping"), "ping"); err != (AccessDenied{}) {
+		t.Errorf("expected AccessDenied but got %v", err)
+	}
+	if reg.Get("ping") == nil || reg.Canon("p") != "ping" {
+		t.Errorf("command or alias was removed without permission")
+	}
+	if err := view.Unalias(s, m, "p"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if reg.Canon("p") == "ping" {
+		t.Errorf("alias wasn't removed")
+	}
+	reg.Add("pong", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {}, "", nil))
+	if err := view.Remove(s, m, "pong"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if reg.Get("pong") != nil {
+		t.Errorf("command wasn't removed")
+	}
+
+	/* Mutating while dispatching shouldn't race, run with -race */
+	var wg sync.WaitGroup
+	for c := 0; c < 8; c++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			reg.Dispatch(s, testMessage("!ping"), "!")
+		}()
+		go func(c int) {
+			defer wg.Done()
+			reg.Alias(string(rune('a'+c)), "ping")
+		}(c)
+	}
+	wg.Wait()
+}
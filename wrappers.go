@@ -0,0 +1,173 @@
+package dgutils
+
+import (
+	"log"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+/*
+ * Decorators adding behavior to arbitrary commands. They all delegate
+ * ErrorHandler and Invoke to the wrapped command, and keep its reply
+ * routable by the register.
+ */
+
+//
+// Wraps cmd so that it's only invoked if pred is satisfied, in addition to whatever
+// checks cmd does on its own
+//
+func WithPredicate(cmd Cmd, pred CmdPredicate) Cmd {
+	return predicatedCmd{cmd, pred}
+}
+
+//
+// Wraps cmd so that each user may only invoke it once every interval
+//
+func WithCooldown(cmd Cmd, interval time.Duration) Cmd {
+	return WithPredicate(cmd, CmdPredicate{Cooldown: Cooldown(interval)})
+}
+
+//
+// Wraps cmd so that every invocation is logged to logger, along with its outcome
+// and how long it took
+//
+func WithLogging(cmd Cmd, logger *log.Logger) Cmd {
+	return loggingCmd{cmd, logger}
+}
+
+type predicatedCmd struct {
+	Cmd
+	pred CmdPredicate
+}
+
+func (cmd predicatedCmd) Invoke(s *discordgo.Session, m *discordgo.MessageCreate, args []string) error {
+	return invokeStandalone(cmd, s, m, args)
+}
+
+func (cmd predicatedCmd) invokeReply(
+	inv *invocation,
+	s *discordgo.Session,
+	m *discordgo.MessageCreate,
+	args []string,
+) (*discordgo.MessageSend, error) {
+	if err := cmd.pred.verify(inv.reg.permissions(), s, m); err != nil {
+		return nil, err
+	}
+	inv.afterParse(func() error {
+		return cmd.pred.record(inv.reg.permissions(), s, m)
+	})
+	return invokeWrapped(cmd.Cmd, inv, s, m, args)
+}
+
+//
+// Returns the predicate the command was wrapped with, the wrapped command's own
+// predicate isn't taken into account; see cmdPredicates for both
+//
+func (cmd predicatedCmd) PredicateInfo() CmdPredicate {
+	return cmd.pred
+}
+
+type loggingCmd struct {
+	Cmd
+	logger *log.Logger
+}
+
+func (cmd loggingCmd) Invoke(s *discordgo.Session, m *discordgo.MessageCreate, args []string) error {
+	return invokeStandalone(cmd, s, m, args)
+}
+
+func (cmd loggingCmd) invokeReply(
+	inv *invocation,
+	s *discordgo.Session,
+	m *discordgo.MessageCreate,
+	args []string,
+) (*discordgo.MessageSend, error) {
+	start := time.Now()
+	reply, err := invokeWrapped(cmd.Cmd, inv, s, m, args)
+	outcome := "ok"
+	if err != nil {
+		outcome = err.Error()
+	}
+	cmd.logger.Printf("[%s] %s %q by %s: %s (took %s)",
+		inv.id, inv.name, args, m.Author.ID, outcome, time.Since(start))
+	return reply, err
+}
+
+//
+// Returns the predicate of the wrapped command, if it has one
+//
+func (cmd loggingCmd) PredicateInfo() CmdPredicate {
+	if info, ok := cmd.Cmd.(interface{ PredicateInfo() CmdPredicate }); ok {
+		return info.PredicateInfo()
+	}
+	return CmdPredicate{}
+}
+
+//
+// Returns every predicate cmd is subject to, outermost first, looking into commands
+// wrapped by this package, as a wrapped command still checks its own predicate
+//
+func cmdPredicates(cmd Cmd) []CmdPredicate {
+	var preds []CmdPredicate
+	for {
+		switch wrapper := cmd.(type) {
+		case predicatedCmd:
+			preds = append(preds, wrapper.pred)
+			cmd = wrapper.Cmd
+			continue
+		case loggingCmd:
+			cmd = wrapper.Cmd
+			continue
+		}
+		if info, ok := cmd.(interface{ PredicateInfo() CmdPredicate }); ok {
+			preds = append(preds, info.PredicateInfo())
+		}
+		return preds
+	}
+}
+
+//
+// Command bound to an invocation through a register, which routes its reply through
+// the register when invoked. Handed to middleware, see CmdRegistry.Use
+//
+type routedCmd struct {
+	Cmd
+	inv *invocation
+}
+
+func (cmd routedCmd) Invoke(s *discordgo.Session, m *discordgo.MessageCreate, args []string) error {
+	rcmd, ok := cmd.Cmd.(replyingCmd)
+	if !ok {
+		return cmd.Cmd.Invoke(s, m, args)
+	}
+	reply, err := rcmd.invokeReply(cmd.inv, s, m, args)
+	if cmd.inv.capture {
+		cmd.inv.reply = reply
+		return err
+	}
+	if err == nil && reply != nil {
+		err = cmd.inv.reg.reply(s, m, reply)
+	}
+	return err
+}
+
+//
+// Invokes a wrapped command, handing its reply back if it has one
+//
+func invokeWrapped(
+	cmd Cmd,
+	inv *invocation,
+	s *discordgo.Session,
+	m *discordgo.MessageCreate,
+	args []string,
+) (*discordgo.MessageSend, error) {
+	if rcmd, ok := cmd.(replyingCmd); ok {
+		return rcmd.invokeReply(inv, s, m, args)
+	}
+	/* There's no telling when cmd converts its arguments, if it does */
+	if err := inv.parsed(); err != nil {
+		return nil, err
+	}
+	return nil, cmd.Invoke(s, m, args)
+}
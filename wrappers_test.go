@@ -0,0 +1,158 @@
+package dgutils
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestWrappers(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	var handled error
+	ping := MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) string {
+		return "pong"
+	}, "", func(s *discordgo.Session, m *discordgo.MessageCreate, err error) {
+		handled = err
+	})
+
+	var logs bytes.Buffer
+	reg := Registry()
+	reg.Add("ping", WithLogging(WithCooldown(ping, time.Hour), log.New(&logs, "", 0)))
+	reg.Add("never", WithPredicate(ping, CmdPredicate{
+		Custom: func(s *discordgo.Session, m *discordgo.MessageCreate, p CmdPredicate) bool {
+			return false
+		},
+	}))
+
+	if _, _, err := reg.Dispatch(s, testMessage("!ping"), "!"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(reqs) != 1 {
+		t.Errorf("expected reply to be sent, got %v", reqs)
+	}
+	if _, _, err := reg.Dispatch(s, testMessage("!ping"), "!"); !errors.As(err, &OnCooldown{}) {
+		t.Errorf("expected OnCooldown but got %v", err)
+	}
+	if _, _, err := reg.Dispatch(s, testMessage("!never"), "!"); err != (AccessDenied{}) {
+		t.Errorf("expected AccessDenied but got %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "ping [] by user: ok") ||
+		!strings.Contains(lines[1], "command is on cooldown") {
+		t.Errorf("unexpected log output:\n%s", logs.String())
+	}
+
+	reg.Handle(s, testMessage("!never"), "!", nil)
+	if !errors.Is(handled, AccessDenied{}) {
+		t.Errorf("error handler of wrapped command wasn't called")
+	}
+}
+
+/* Cmd running fn around the command it wraps, for testing middleware */
+type aroundCmd struct {
+	Cmd
+	fn func(next Cmd, s *discordgo.Session, m *discordgo.MessageCreate, args []string) error
+}
+
+func (cmd aroundCmd) Invoke(s *discordgo.Session, m *discordgo.MessageCreate, args []string) error {
+	return cmd.fn(cmd.Cmd, s, m, args)
+}
+
+func TestMiddleware(t *testing.T) {
+	var reqs []*http.Request
+	s := testRESTSession(&reqs)
+	var trace []string
+	tracing := func(name string) CmdMiddleware {
+		return func(next Cmd) Cmd {
+			return aroundCmd{next, func(next Cmd, s *discordgo.Session, m *discordgo.MessageCreate, args []string) error {
+				trace = append(trace, name+" before "+strings.Join(args, " "))
+				err := next.Invoke(s, m, args)
+				trace = append(trace, name+" after")
+				return err
+			}}
+		}
+	}
+	reg := Registry()
+	reg.Use(tracing("outer"), tracing("inner"))
+	reg.Add("echo", MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate, words []string) string {
+		trace = append(trace, "echo")
+		return strings.Join(words, " ")
+	}, "", nil))
+	reg.Add("secret", MustPredicatedCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+		trace = append(trace, "secret")
+	}, "", nil, CmdPredicate{Custom: func(s *discordgo.Session, m *discordgo.MessageCreate, p CmdPredicate) bool {
+		return false
+	}}))
+
+	if err := reg.Exec(s, testMessage(""), "echo", "hi"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expect := []string{"outer before hi", "inner before hi", "echo", "inner after", "outer after"}
+	if !reflect.DeepEqual(trace, expect) {
+		t.Errorf("expected %q but got %q", expect, trace)
+	}
+	if len(reqs) != 1 {
+		t.Errorf("expected reply to be sent, got %d requests", len(reqs))
+	}
+
+	trace = nil
+	if err := reg.Exec(s, testMessage(""), "secret"); err != (AccessDenied{}) {
+		t.Errorf("expected AccessDenied but got %v", err)
+	}
+	if len(trace) != 4 || trace[2] != "inner after" {
+		t.Errorf("expected predicate to be checked inside middleware, got %q", trace)
+	}
+
+	denied := errors.New("maintenance")
+	reg.Use(func(next Cmd) Cmd {
+		return aroundCmd{next, func(next Cmd, s *discordgo.Session, m *discordgo.MessageCreate, args []string) error {
+			return denied
+		}}
+	})
+	trace = nil
+	if err := reg.Exec(s, testMessage(""), "echo", "hi"); err != denied {
+		t.Errorf("expected middleware error but got %v", err)
+	}
+	if len(trace) != 4 || trace[2] != "inner after" {
+		t.Errorf("expected command not to run, got %q", trace)
+	}
+}
+
+func TestWrappedPredicates(t *testing.T) {
+	s := testSession()
+	ban := MustPredicatedCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {
+	}, "", nil, CmdPredicate{Permissions: discordgo.PermissionBanMembers})
+	reg := Registry()
+	reg.Add("ban", WithLogging(ban, log.New(&bytes.Buffer{}, "", 0)))
+	reg.Add("softban", WithCooldown(ban, time.Hour))
+	reg.Add("ping", WithCooldown(MustCommand(func(s *discordgo.Session, m *discordgo.MessageCreate) {}, "", nil), time.Hour))
+	reg.SetPermissionResolver(func(s *discordgo.Session, m *discordgo.MessageCreate, required int) (bool, error) {
+		return false, nil
+	})
+
+	m := testMessage("!help")
+	m.GuildID = "guild"
+	if got, expect := reg.AvailableTo(s, m), []string{"ping"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected %v but got %v", expect, got)
+	}
+	for _, name := range []string{"ban", "softban"} {
+		if allowed, reason := reg.Explain(s, m, name); allowed || !strings.Contains(reason, "Ban Members") {
+			t.Errorf("%s: expected to be denied for lack of permissions, got (%v, %q)", name, allowed, reason)
+		}
+	}
+	if allowed, _ := reg.Explain(s, m, "ping"); !allowed {
+		t.Errorf("ping: expected to be allowed")
+	}
+	if pred := reg.Get("ban").(interface{ PredicateInfo() CmdPredicate }).PredicateInfo(); pred.Permissions == 0 {
+		t.Errorf("logging wrapper didn't forward the wrapped command's predicate")
+	}
+}